@@ -2,109 +2,457 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"time"
+	"log"
+	"os"
+	"os/signal"
 	"strings"
-	"context"
-	"github.com/retroflexer/etcdutils"
+	"syscall"
+	"time"
+
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	"github.com/retroflexer/etcdutils"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
-	memberPeerURLs string
-	endPoints string
-	dialTimeout time.Duration = 5* time.Second
+	memberPeerURLs      string
+	endPoints           string
+	dialTimeout         time.Duration = 5 * time.Second
+	memberName          string
+	dataDir             string
+	initialCluster      string
+	initialClusterToken string
+	dryRun              bool
+	configFile          string
+	kubeconfigOutput    string
+	caCert              string
+	clientCert          string
+	clientKey           string
+	memberCertParams    etcdutils.MemberCertParams
+	templateParams      etcdutils.TemplateParams
+	signerListen        string
+	signerIPs           []string
+	skipHashCheck       bool
+	prefixDepth         int
+	snapshotOpts        etcdutils.SnapshotOptions
+	snapshotKeyFile     string
+	snapshotRecipient   string
+	snapshotIdentity    string
+	serviceManager      string
+	opts                = etcdutils.DefaultOptions()
 )
 
-func addMemberCommandFunc(cmd *cobra.Command, args []string) {
-
-	configFileDir := "/etc/kubernetes"
-	assetDir := "./assets"
-	manifestDir := "/etc/kubernetes/manifests"
-	manifestStoppedDir := assetDir + "/manifests-stopped"
-	var err error
-
-	// init
-	if err = etcdutils.Init(assetDir); err != nil {
-		return
+// loadConfigFile applies the options from the --config file. Flags given on
+// the command line take precedence over the file.
+func loadConfigFile(cmd *cobra.Command) error {
+	if configFile == "" {
+		return nil
+	}
+	var changed []*pflag.Flag
+	values := map[string][]string{}
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		changed = append(changed, f)
+		// String() of a slice flag is "[a,b]", which Set would take as a
+		// single element, so slices are restored as they are.
+		if v, ok := f.Value.(pflag.SliceValue); ok {
+			values[f.Name] = v.GetSlice()
+		} else {
+			values[f.Name] = []string{f.Value.String()}
+		}
+	})
+	if err := etcdutils.LoadOptionsFile(configFile, opts); err != nil {
+		return err
+	}
+	for _, f := range changed {
+		var err error
+		if v, ok := f.Value.(pflag.SliceValue); ok {
+			err = v.Replace(values[f.Name])
+		} else {
+			err = f.Value.Set(values[f.Name][0])
+		}
+		if err != nil {
+			return fmt.Errorf("invalid argument for --%s: %v", f.Name, err)
+		}
 	}
+	return nil
+}
 
-	// backup manifest
-	if err = etcdutils.BackupManifest(manifestDir, assetDir); err != nil {
-		return
+// fatalf prints the dry-run plan collected so far, so it is not lost when a
+// command fails, and exits like log.Fatalf.
+func fatalf(format string, v ...interface{}) {
+	if opts.Plan != nil {
+		opts.Plan.Print(os.Stdout)
 	}
+	log.Fatalf(format, v...)
+}
 
-	// backup etcdconf
-	if err = etcdutils.BackupEtcdConf(assetDir); err != nil {
-		return
+// clientTLSFiles returns the etcd client certs from --cacert, --cert and
+// --key, defaulting to the backed up ones.
+func clientTLSFiles() etcdutils.ClientTLSFiles {
+	files := etcdutils.EtcdClientTLSFiles(opts)
+	if caCert != "" {
+		files.CACert = caCert
+	}
+	if clientCert != "" {
+		files.Cert = clientCert
+	}
+	if clientKey != "" {
+		files.Key = clientKey
 	}
+	return files
+}
 
-	// backup client certs 
-	if err = etcdutils.BackupEtcdClientCerts(configFileDir, assetDir); err != nil {
-		return
+// clientConfig returns the client config for endpoints. https:// and
+// unixs:// endpoints are reached with the client certs from --cacert, --cert
+// and --key; bare host:port endpoints are insecure, as in etcdctl.
+func clientConfig(endpoints ...string) (clientv3.Config, error) {
+	cfg := clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: dialTimeout,
+	}
+	secure := false
+	for _, ep := range endpoints {
+		secure = secure || strings.HasPrefix(ep, "https://") || strings.HasPrefix(ep, "unixs://")
+	}
+	if !secure {
+		return cfg, nil
 	}
 
-	// stop etcd
-	if err = etcdutils.StopEtcd(manifestDir, manifestStoppedDir); err != nil {
-		return
+	tlsConfig, err := etcdutils.ClientTLSConfig(opts, clientTLSFiles())
+	if err != nil {
+		err = fmt.Errorf("could not load etcd client certs: %v", err)
+		if opts.DryRun() {
+			// Nothing is dialed in a dry run, and the default certs are
+			// only backed up by the run itself.
+			log.Printf("%v\n", err)
+			return cfg, nil
+		}
+		return cfg, err
 	}
+	cfg.TLS = tlsConfig
+	return cfg, nil
+}
 
-	cfg:= clientv3.Config{
-		Endpoints:   []string{"https://"+args[0]+":2379"},
-		DialTimeout: dialTimeout,
+// runJournaled runs wf with its journal kept in the asset dir, resuming an
+// earlier interrupted run of the same command.
+func runJournaled(wf *etcdutils.Workflow) error {
+	j, err := etcdutils.OpenJournal(opts, wf.Name)
+	if err != nil {
+		return err
 	}
+	wf.Journal = j
+	return wf.Run(context.Background())
+}
+
+func addMemberCommandFunc(cmd *cobra.Command, args []string) {
+	endpoint := "https://" + args[0] + ":2379"
 	newMemberName := args[1]
 	peerURLs := strings.Split(memberPeerURLs, ",")
-	etcdutils.EtcdMemberAdd(context.Background(), cfg, newMemberName, peerURLs) 
-	return
+
+	wf := etcdutils.NewWorkflow("addmember",
+		etcdutils.Step{
+			Name: "init asset dir",
+			Do:   func(ctx context.Context) error { return etcdutils.Init(opts) },
+		},
+		etcdutils.Step{
+			Name: "back up etcd manifest",
+			Do:   func(ctx context.Context) error { return etcdutils.BackupManifest(opts) },
+		},
+		etcdutils.Step{
+			Name: "back up etcd.conf",
+			Do:   func(ctx context.Context) error { return etcdutils.BackupEtcdConf(opts) },
+		},
+		etcdutils.Step{
+			Name: "back up etcd client certs",
+			Do:   func(ctx context.Context) error { return etcdutils.BackupEtcdClientCerts(opts) },
+		},
+		etcdutils.StopEtcdStep(opts),
+		etcdutils.WaitForEtcdStoppedStep(opts),
+		etcdutils.Step{
+			Name:   "add member",
+			Inputs: map[string]string{"name": newMemberName, "peer-urls": memberPeerURLs},
+			Do: func(ctx context.Context) error {
+				cfg, err := clientConfig(endpoint)
+				if err != nil {
+					return err
+				}
+				return etcdutils.EtcdMemberAdd(ctx, opts, cfg, newMemberName, peerURLs)
+			},
+		},
+	)
+	if err := runJournaled(wf); err != nil {
+		fatalf("addmember failed: %v", err)
+	}
 }
 
 func delMemberCommandFunc(cmd *cobra.Command, args []string) {
+	name := args[0]
 
-	configFileDir := "/etc/kubernetes"
-	assetDir := "./assets"
+	wf := etcdutils.NewWorkflow("delmember",
+		etcdutils.Step{
+			Name: "init asset dir",
+			Do:   func(ctx context.Context) error { return etcdutils.Init(opts) },
+		},
+		etcdutils.Step{
+			Name: "back up etcd client certs",
+			Do:   func(ctx context.Context) error { return etcdutils.BackupEtcdClientCerts(opts) },
+		},
+		etcdutils.Step{
+			Name:   "remove member",
+			Inputs: map[string]string{"name": name},
+			Do: func(ctx context.Context) error {
+				cfg, err := clientConfig(strings.Split(endPoints, ",")...)
+				if err != nil {
+					return err
+				}
+				return etcdutils.EtcdMemberRemove(ctx, opts, cfg, name)
+			},
+		},
+	)
+	if err := runJournaled(wf); err != nil {
+		fatalf("delmember failed: %v", err)
+	}
+}
+
+// snapshotKey loads the snapshot key given by --key-file, --recipient or
+// --identity, if any.
+func snapshotKey() *etcdutils.SnapshotKey {
+	var key *etcdutils.SnapshotKey
 	var err error
+	switch {
+	case snapshotKeyFile != "":
+		key, err = etcdutils.LoadSnapshotKeyFile(opts, snapshotKeyFile)
+	case snapshotRecipient != "":
+		key, err = etcdutils.LoadSnapshotRecipient(opts, snapshotRecipient)
+	case snapshotIdentity != "":
+		key, err = etcdutils.LoadSnapshotIdentity(opts, snapshotIdentity)
+	default:
+		return nil
+	}
+	if err != nil {
+		fatalf("could not load snapshot key: %v", err)
+	}
+	return key
+}
 
-	// init
-	if err = etcdutils.Init(assetDir); err != nil {
-		return
+func snapshotSaveFunc(cmd *cobra.Command, args []string) {
+	cfg, err := clientConfig(strings.Split(endPoints, ",")...)
+	if err != nil {
+		fatalf("%v", err)
 	}
+	dbPath := args[0]
+	snapshotOpts.Key = snapshotKey()
 
-	// backup client certs 
-	if err = etcdutils.BackupEtcdClientCerts(configFileDir, assetDir); err != nil {
-		return
+	if err = etcdutils.SaveSnapshot(context.Background(), opts, cfg, dbPath, snapshotOpts); err != nil {
+		fatalf("%v", err)
 	}
+}
 
-	// remove the member by name
-	cfg:= clientv3.Config{
-		Endpoints:   strings.Split(endPoints, ","),
-		DialTimeout: dialTimeout,
+// localMemberName returns the name of this node's etcd member as found by
+// ValidateEtcdName. When the sources disagree it lists them and fails, as
+// only the operator can tell which name is right.
+func localMemberName() (string, error) {
+	report, err := etcdutils.ValidateEtcdName(context.Background(), opts, clientv3.Config{})
+	if err != nil {
+		for _, s := range report.Sources {
+			log.Printf("  %s: %q %s\n", s.Source, s.Name, s.Detail)
+		}
+		return "", err
 	}
-	memberName := args[0]
-	etcdutils.EtcdMemberRemove(context.Background(), cfg, memberName) 
-	return
+	log.Printf("Using etcd member name %s\n", report.Canonical)
+	return report.Canonical, nil
 }
 
-func snapshotSaveFunc(cmd *cobra.Command, args []string) {
-	cfg:= clientv3.Config{
-		Endpoints:   strings.Split(endPoints, ","),
-		DialTimeout: dialTimeout,
+// memberConfig returns the configuration to restore this member with: the
+// flag defaults, overridden by the node's etcd.conf, overridden in turn by
+// the flags given on the command line. The data-dir is kept in opts, so
+// the recovery workflow restores into the same one, resolved below --root.
+func memberConfig(cmd *cobra.Command) (*embed.Config, []string) {
+	flags := cmd.Flags()
+	explicitDataDir := ""
+	if flags.Changed("etcd-data-dir") {
+		explicitDataDir = opts.EtcdDataDir
+	}
+	if flags.Changed("data-dir") {
+		explicitDataDir = dataDir
+	}
+
+	cfg := embed.NewConfig()
+	cfg.InitialCluster = initialCluster
+	cfg.InitialClusterToken = initialClusterToken
+	peerURLs := memberPeerURLs
+	if conf, err := etcdutils.LoadEtcdConf(opts); err != nil {
+		log.Printf("Could not read etcd.conf, using flag defaults: %v\n", err)
+	} else {
+		if err = conf.ApplyTo(opts, cfg); err != nil {
+			fatalf("invalid etcd.conf: %v", err)
+		}
+		if len(conf.InitialAdvertisePeerURLs) != 0 {
+			peerURLs = strings.Join(conf.InitialAdvertisePeerURLs, ",")
+		}
+	}
+
+	if explicitDataDir != "" {
+		opts.EtcdDataDir = explicitDataDir
+		cfg.Dir = opts.DataDir()
+	}
+	if flags.Changed("initial-cluster") {
+		cfg.InitialCluster = initialCluster
+	}
+	if flags.Changed("initial-cluster-token") {
+		cfg.InitialClusterToken = initialClusterToken
+	}
+	if flags.Changed("peer-urls") {
+		peerURLs = memberPeerURLs
+	}
+	cfg.Name = memberName
+	if peerURLs == "" {
+		return cfg, nil
+	}
+	return cfg, strings.Split(peerURLs, ",")
+}
+
+func snapshotRestoreFunc(cmd *cobra.Command, args []string) {
+	if memberName == "" {
+		var err error
+		if memberName, err = localMemberName(); err != nil {
+			fatalf("%v, pass --name to override", err)
+		}
+	}
+	cfg, peerURLs := memberConfig(cmd)
+	if cfg.Dir == "" {
+		cfg.Dir = memberName + ".etcd"
 	}
 	dbPath := args[0]
 
-	etcdutils.SaveSnapshot(context.Background(), cfg, dbPath) 
+	if err := etcdutils.RestoreSnapshot(context.Background(), opts, *cfg, peerURLs, dbPath, skipHashCheck, snapshotKey()); err != nil {
+		fatalf("restore failed: %v", err)
+	}
 }
 
+func recoverFunc(cmd *cobra.Command, args []string) {
+	if memberName == "" {
+		var err error
+		if memberName, err = localMemberName(); err != nil {
+			fatalf("%v, pass --name to override", err)
+		}
+	}
+	cfg, peerURLs := memberConfig(cmd)
+	if cfg.InitialCluster == "" || len(peerURLs) == 0 {
+		fatalf("etcd.conf has no initial cluster or peer URLs, pass --initial-cluster and --peer-urls")
+	}
 
-func main() {
-	var echoTimes int
+	rc := etcdutils.RecoverConfig{
+		SnapshotPath:  args[0],
+		Etcd:          *cfg,
+		PeerURLs:      peerURLs,
+		SkipHashCheck: skipHashCheck,
+		SnapshotKey:   snapshotKey(),
+	}
+	if endPoints != "" {
+		var err error
+		if rc.Client, err = clientConfig(strings.Split(endPoints, ",")...); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	if err := etcdutils.Recover(context.Background(), opts, rc); err != nil {
+		fatalf("recovery failed: %v", err)
+	}
+}
 
+func genKubeconfigFunc(cmd *cobra.Command, args []string) {
+	params := etcdutils.KubeconfigParams{
+		RecoveryServerIP: args[0],
+		ClusterName:      args[1],
+	}
+	output := kubeconfigOutput
+	if output == "" {
+		output = opts.AssetPath("shared", "kubeconfig")
+	}
+	if err := etcdutils.WriteKubeconfig(opts, params, output); err != nil {
+		fatalf("could not write kubeconfig: %v", err)
+	}
+}
+
+func manifestsRenderFunc(cmd *cobra.Command, args []string) {
+	if templateParams.MemberName == "" {
+		var err error
+		if templateParams.MemberName, err = localMemberName(); err != nil {
+			fatalf("%v, pass --name to override", err)
+		}
+	}
+	if err := etcdutils.PopulateManifests(opts, templateParams); err != nil {
+		fatalf("could not render manifests: %v", err)
+	}
+}
+
+func certsInspectFunc(cmd *cobra.Command, args []string) {
+	report, err := etcdutils.InspectCerts(opts, clientTLSFiles())
+	if err != nil {
+		fatalf("could not inspect certs: %v", err)
+	}
+	report.Print(os.Stdout)
+	if report.Failed() {
+		os.Exit(1)
+	}
+}
+
+func certsGenerateFunc(cmd *cobra.Command, args []string) {
+	if err := etcdutils.GenerateMemberCerts(opts, memberCertParams); err != nil {
+		fatalf("could not generate certs: %v", err)
+	}
+}
+
+func signerServeFunc(cmd *cobra.Command, args []string) {
+	ca, err := etcdutils.LoadCertAuthority(opts, memberCertParams.CACert, memberCertParams.CAKey)
+	if err != nil {
+		fatalf("could not load signer CA: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+	if err = etcdutils.ServeSigner(ctx, etcdutils.NewSigner(ca), signerListen, signerIPs); err != nil {
+		fatalf("signer failed: %v", err)
+	}
+}
+
+func snapshotStatusFunc(cmd *cobra.Command, args []string) {
+	status, err := etcdutils.InspectSnapshot(opts, args[0], prefixDepth, snapshotKey())
+	if err != nil {
+		fatalf("could not inspect snapshot: %v", err)
+	}
+	status.Print(os.Stdout)
+}
+
+func snapshotKeygenFunc(cmd *cobra.Command, args []string) {
+	if err := etcdutils.GenerateSnapshotIdentity(opts, args[0]); err != nil {
+		fatalf("could not generate snapshot identity: %v", err)
+	}
+	log.Printf("Wrote %s, encrypt snapshots for it with --recipient %s.pub\n", args[0], args[0])
+}
+
+func preflightFunc(cmd *cobra.Command, args []string) {
+	report := etcdutils.ValidateEnvironment(opts)
+	report.Print(os.Stdout)
+	if report.Failed() {
+		os.Exit(1)
+	}
+}
+
+func main() {
 	var cmdAddMember = &cobra.Command{
 		Use:   "addmember <recoveryserverIP> <membername> [options]",
 		Short: "Adds a member into the cluster",
-		Args: cobra.MinimumNArgs(2),
+		Args:  cobra.MinimumNArgs(2),
 		Run:   addMemberCommandFunc,
 	}
 
@@ -113,7 +461,7 @@ func main() {
 	var cmdDelMember = &cobra.Command{
 		Use:   "delmember <membername> [options]",
 		Short: "Deletes a member from the cluster",
-		Args: cobra.MinimumNArgs(1),
+		Args:  cobra.MinimumNArgs(1),
 		Run:   delMemberCommandFunc,
 	}
 
@@ -121,26 +469,193 @@ func main() {
 
 	var cmdSnapshotSave = &cobra.Command{
 		Use:   "savesnapshot <filename>",
-		Short: "Save snapshot to file specified",
-		Args: cobra.MinimumNArgs(1),
-		Run: snapshotSaveFunc,
+		Short: "Save snapshot to file specified, or to stdout if it is -",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   snapshotSaveFunc,
 	}
-	cmdDelMember.Flags().StringVar(&endPoints, "endpoints", "", "comma separated endpoint URLs")
+	cmdSnapshotSave.Flags().StringVar(&endPoints, "endpoints", "", "comma separated endpoint URLs, the snapshot is taken from the most up to date follower")
+	cmdSnapshotSave.Flags().StringVar(&snapshotOpts.Compression, "compress", "", "compress the snapshot with gzip or zstd.")
+	cmdSnapshotSave.Flags().StringVar(&snapshotKeyFile, "key-file", "", "encrypt the snapshot with the secret in this file.")
+	cmdSnapshotSave.Flags().StringVar(&snapshotRecipient, "recipient", "", "encrypt the snapshot for the X25519 public key in this file.")
 
 	var cmdSnapshotRestore = &cobra.Command{
-		Use:   "restore <filename>",
+		Use:   "restore <filename> [options]",
 		Short: "Restores the database from a file",
-		Args: cobra.MinimumNArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
-			for i := 0; i < echoTimes; i++ {
-				fmt.Println("Echo: " + strings.Join(args, " "))
+		Args:  cobra.MinimumNArgs(1),
+		Run:   snapshotRestoreFunc,
+	}
+
+	cmdSnapshotRestore.Flags().StringVar(&memberName, "name", "", "human-readable name for the restored member, defaults to this node's member name and is required where that cannot be found or is ambiguous.")
+	cmdSnapshotRestore.Flags().StringVar(&dataDir, "data-dir", "", "path to the data directory, defaults to etcd.conf or <name>.etcd.")
+	cmdSnapshotRestore.Flags().StringVar(&initialCluster, "initial-cluster", "default=http://localhost:2380", "initial cluster configuration for restore bootstrap, defaults to etcd.conf.")
+	cmdSnapshotRestore.Flags().StringVar(&initialClusterToken, "initial-cluster-token", "etcd-cluster", "initial cluster token for the etcd cluster during restore bootstrap, defaults to etcd.conf.")
+	cmdSnapshotRestore.Flags().StringVar(&memberPeerURLs, "peer-urls", "http://localhost:2380", "comma separated peer URLs for the restored member, defaults to etcd.conf.")
+
+	cmdSnapshotRestore.Flags().BoolVar(&skipHashCheck, "skip-hash-check", false, "restore a snapshot whose hash or metadata does not match.")
+	cmdSnapshotRestore.Flags().StringVar(&snapshotKeyFile, "key-file", "", "decrypt the snapshot with the secret in this file.")
+	cmdSnapshotRestore.Flags().StringVar(&snapshotIdentity, "identity", "", "decrypt the snapshot with the X25519 private key in this file.")
+
+	var cmdRecover = &cobra.Command{
+		Use:   "recover <snapshot> [options]",
+		Short: "Restores this master's etcd member from a snapshot",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   recoverFunc,
+	}
+
+	cmdRecover.Flags().StringVar(&memberName, "name", "", "name of this etcd member, defaults to the name in etcd.conf and the etcd manifest.")
+	cmdRecover.Flags().StringVar(&initialCluster, "initial-cluster", "", "initial cluster configuration for restore bootstrap, defaults to etcd.conf.")
+	cmdRecover.Flags().StringVar(&initialClusterToken, "initial-cluster-token", "etcd-cluster", "initial cluster token for the etcd cluster during restore bootstrap, defaults to etcd.conf.")
+	cmdRecover.Flags().StringVar(&memberPeerURLs, "peer-urls", "", "comma separated peer URLs for this member, defaults to etcd.conf.")
+	cmdRecover.Flags().StringVar(&endPoints, "endpoints", "", "client URL of this member to wait on until it is healthy.")
+	cmdRecover.Flags().BoolVar(&skipHashCheck, "skip-hash-check", false, "restore a snapshot whose hash or metadata does not match.")
+	cmdRecover.Flags().StringVar(&snapshotKeyFile, "key-file", "", "decrypt the snapshot with the secret in this file.")
+	cmdRecover.Flags().StringVar(&snapshotIdentity, "identity", "", "decrypt the snapshot with the X25519 private key in this file.")
+
+	var cmdPreflight = &cobra.Command{
+		Use:   "preflight",
+		Short: "Checks that this node is ready for a recovery",
+		Args:  cobra.NoArgs,
+		Run:   preflightFunc,
+	}
+
+	var cmdGenKubeconfig = &cobra.Command{
+		Use:   "gen-kubeconfig <recoveryserverIP> <clustername> [options]",
+		Short: "Writes the kubeconfig for the recovery cert signer from the backed up etcd client certs",
+		Args:  cobra.MinimumNArgs(2),
+		Run:   genKubeconfigFunc,
+	}
+
+	cmdGenKubeconfig.Flags().StringVar(&kubeconfigOutput, "output", "", "path to write the kubeconfig to, defaults to <asset-dir>/shared/kubeconfig.")
+
+	var cmdSnapshot = &cobra.Command{
+		Use:   "snapshot",
+		Short: "Inspects snapshot files and manages their encryption keys",
+	}
+	var cmdSnapshotStatus = &cobra.Command{
+		Use:     "status <filename>",
+		Aliases: []string{"inspect"},
+		Short:   "Reports hash, revision, size and per prefix usage of a snapshot or db file",
+		Args:    cobra.ExactArgs(1),
+		Run:     snapshotStatusFunc,
+	}
+	cmdSnapshotStatus.Flags().IntVar(&prefixDepth, "prefix-depth", etcdutils.DefaultPrefixDepth, "number of key path segments usage is grouped by.")
+	cmdSnapshotStatus.Flags().StringVar(&snapshotKeyFile, "key-file", "", "decrypt the snapshot with the secret in this file.")
+	cmdSnapshotStatus.Flags().StringVar(&snapshotIdentity, "identity", "", "decrypt the snapshot with the X25519 private key in this file.")
+	cmdSnapshot.AddCommand(cmdSnapshotStatus)
+	cmdSnapshot.AddCommand(&cobra.Command{
+		Use:   "keygen <identity-file>",
+		Short: "Generates an X25519 key pair to encrypt snapshots for",
+		Args:  cobra.ExactArgs(1),
+		Run:   snapshotKeygenFunc,
+	})
+
+	var cmdManifests = &cobra.Command{
+		Use:   "manifests",
+		Short: "Renders the static pod manifests used during recovery",
+	}
+	var cmdManifestsRender = &cobra.Command{
+		Use:   "render [options]",
+		Short: "Renders the etcd member and cert recovery manifests into the stopped manifest dir",
+		Args:  cobra.NoArgs,
+		Run:   manifestsRenderFunc,
+	}
+	cmdManifestsRender.Flags().StringVar(&templateParams.MemberName, "name", "", "name of this etcd member, defaults to the name in etcd.conf and the etcd manifest.")
+	cmdManifestsRender.Flags().StringVar(&templateParams.IP, "ip", "", "IP address of this member.")
+	cmdManifestsRender.Flags().StringVar(&templateParams.DNSName, "dns-name", "", "name of this member in the discovery domain, e.g. etcd-0.<cluster domain>.")
+	cmdManifestsRender.Flags().StringVar(&templateParams.DiscoveryDomain, "discovery-domain", "", "etcd discovery domain.")
+	cmdManifestsRender.Flags().StringVar(&templateParams.InitialCluster, "initial-cluster", "", "initial cluster the member joins.")
+	cmdManifestsRender.Flags().StringVar(&templateParams.InitialClusterState, "initial-cluster-state", "existing", "initial cluster state of the member.")
+	cmdManifestsRender.Flags().StringVar(&templateParams.EtcdImage, "etcd-image", "", "etcd image.")
+	cmdManifestsRender.Flags().StringVar(&templateParams.SetupEtcdEnvironmentImage, "setup-etcd-environment-image", "", "setup-etcd-environment image of the cert recovery pod.")
+	cmdManifestsRender.Flags().StringVar(&templateParams.KubeClientAgentImage, "kube-client-agent-image", "", "kube-client-agent image of the cert recovery pod.")
+	cmdManifests.AddCommand(cmdManifestsRender)
+
+	var cmdCerts = &cobra.Command{
+		Use:   "certs",
+		Short: "Inspects and generates the etcd TLS certificates",
+	}
+	cmdCerts.AddCommand(&cobra.Command{
+		Use:   "inspect",
+		Short: "Reports expiry, SANs, chain and key of the etcd member and client certs",
+		Args:  cobra.NoArgs,
+		Run:   certsInspectFunc,
+	})
+
+	var cmdCertsGenerate = &cobra.Command{
+		Use:   "generate [options]",
+		Short: "Issues the peer, server and metric certs of this member into the static resource dir",
+		Args:  cobra.NoArgs,
+		Run:   certsGenerateFunc,
+	}
+	cmdCertsGenerate.Flags().StringVar(&memberCertParams.DNSName, "dns-name", "", "name of this member in the discovery domain, e.g. etcd-0.<cluster domain>.")
+	cmdCertsGenerate.Flags().StringVar(&memberCertParams.DiscoveryDomain, "discovery-domain", "", "etcd discovery domain added to the peer cert.")
+	cmdCertsGenerate.Flags().StringSliceVar(&memberCertParams.IPs, "ip", nil, "IP addresses of this member.")
+	cmdCertsGenerate.Flags().StringVar(&memberCertParams.CACert, "signer-cert", "", "etcd signer CA cert.")
+	cmdCertsGenerate.Flags().StringVar(&memberCertParams.CAKey, "signer-key", "", "etcd signer CA key.")
+	cmdCertsGenerate.MarkFlagRequired("dns-name")
+	cmdCertsGenerate.MarkFlagRequired("ip")
+	cmdCertsGenerate.MarkFlagRequired("signer-cert")
+	cmdCertsGenerate.MarkFlagRequired("signer-key")
+	cmdCerts.AddCommand(cmdCertsGenerate)
+
+	var cmdSigner = &cobra.Command{
+		Use:   "signer",
+		Short: "Runs the etcd certificate signer used during cert recovery",
+	}
+	var cmdSignerServe = &cobra.Command{
+		Use:   "serve [options]",
+		Short: "Signs etcd member certificate signing requests with the etcd CA",
+		Args:  cobra.NoArgs,
+		Run:   signerServeFunc,
+	}
+	cmdSignerServe.Flags().StringVar(&signerListen, "listen", ":9943", "address to serve on.")
+	cmdSignerServe.Flags().StringSliceVar(&signerIPs, "ip", nil, "IP addresses clients reach the signer on, usually the recovery server IP of the kubeconfig, added to its serving cert.")
+	cmdSignerServe.Flags().StringVar(&memberCertParams.CACert, "signer-cert", "", "etcd signer CA cert.")
+	cmdSignerServe.Flags().StringVar(&memberCertParams.CAKey, "signer-key", "", "etcd signer CA key.")
+	cmdSignerServe.MarkFlagRequired("ip")
+	cmdSignerServe.MarkFlagRequired("signer-cert")
+	cmdSignerServe.MarkFlagRequired("signer-key")
+	cmdSigner.AddCommand(cmdSignerServe)
+
+	var rootCmd = &cobra.Command{
+		Use: "etcdutil",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if err := loadConfigFile(cmd); err != nil {
+				fatalf("could not load config file: %v", err)
+			}
+			switch serviceManager {
+			case "systemctl":
+				opts.Services = etcdutils.SystemctlManager{}
+			case "dbus":
+				opts.Services = etcdutils.DBusManager{}
+			default:
+				fatalf("unknown service manager %q", serviceManager)
+			}
+			if dryRun {
+				opts.Plan = &etcdutils.Plan{}
+			}
+		},
+		PersistentPostRun: func(cmd *cobra.Command, args []string) {
+			if opts.Plan != nil {
+				opts.Plan.Print(os.Stdout)
 			}
 		},
 	}
-
-	var rootCmd = &cobra.Command{Use: "etcdutil"}
-	rootCmd.AddCommand(cmdAddMember, cmdDelMember, cmdSnapshotSave, cmdSnapshotRestore)
+	rootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "print the actions a command would take without changing anything.")
+	rootCmd.PersistentFlags().StringVar(&serviceManager, "service-manager", "systemctl", "how to control kubelet, systemctl or dbus.")
+	rootCmd.PersistentFlags().StringVar(&caCert, "cacert", "", "CA bundle of the etcd client certs, defaults to the backed up etcd-ca-bundle.crt.")
+	rootCmd.PersistentFlags().StringVar(&clientCert, "cert", "", "etcd client cert, defaults to the backed up etcd-client.crt.")
+	rootCmd.PersistentFlags().StringVar(&clientKey, "key", "", "etcd client key, defaults to the backed up etcd-client.key.")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "YAML file with the path options below.")
+	rootCmd.PersistentFlags().StringVar(&opts.Root, "root", opts.Root, "filesystem root all other paths are resolved under.")
+	rootCmd.PersistentFlags().StringVar(&opts.KubernetesDir, "kubernetes-dir", opts.KubernetesDir, "kubernetes config dir holding static-pod-resources.")
+	rootCmd.PersistentFlags().StringVar(&opts.AssetDir, "asset-dir", opts.AssetDir, "dir for backups, journals and other recovery assets.")
+	rootCmd.PersistentFlags().StringVar(&opts.ManifestDir, "manifest-dir", opts.ManifestDir, "static pod manifest dir.")
+	rootCmd.PersistentFlags().StringVar(&opts.ManifestStoppedDir, "manifest-stopped-dir", opts.ManifestStoppedDir, "dir stopped static pod manifests are moved to, defaults to <asset-dir>/manifests-stopped.")
+	rootCmd.PersistentFlags().StringVar(&opts.EtcdManifestName, "etcd-manifest", opts.EtcdManifestName, "file name of the etcd static pod manifest.")
+	rootCmd.PersistentFlags().StringVar(&opts.EtcdConfPath, "etcd-conf", opts.EtcdConfPath, "path to etcd.conf.")
+	rootCmd.PersistentFlags().StringVar(&opts.EtcdDataDir, "etcd-data-dir", opts.EtcdDataDir, "path to the etcd data directory.")
+	rootCmd.PersistentFlags().StringVar(&opts.EtcdStaticResourceDir, "etcd-static-resource-dir", opts.EtcdStaticResourceDir, "dir holding the etcd TLS certificates.")
+	rootCmd.AddCommand(cmdAddMember, cmdDelMember, cmdSnapshotSave, cmdSnapshotRestore, cmdRecover, cmdPreflight, cmdGenKubeconfig, cmdManifests, cmdCerts, cmdSigner, cmdSnapshot)
 	rootCmd.Execute()
 }
-
-
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/retroflexer/etcdutils"
+	"github.com/spf13/cobra"
+)
+
+func TestLoadConfigFileKeepsFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcdutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err = ioutil.WriteFile(path, []byte("assetDir: /srv/assets\nmanifestDir: /srv/manifests\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(o *etcdutils.Options, c string) { opts, configFile = o, c }(opts, configFile)
+	opts, configFile = etcdutils.DefaultOptions(), path
+
+	var ips []string
+	cmd := &cobra.Command{}
+	cmd.Flags().StringSliceVar(&ips, "ip", nil, "")
+	cmd.Flags().StringVar(&opts.AssetDir, "asset-dir", opts.AssetDir, "")
+	if err = cmd.Flags().Parse([]string{"--ip", "10.0.0.1", "--ip", "10.0.0.2", "--asset-dir", "/flag/assets"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = loadConfigFile(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.1", "10.0.0.2"}; !reflect.DeepEqual(ips, want) {
+		t.Errorf("--ip is %q, want %q", ips, want)
+	}
+	if opts.AssetDir != "/flag/assets" {
+		t.Errorf("asset dir is %s, want the flag's /flag/assets", opts.AssetDir)
+	}
+	if opts.ManifestDir != "/srv/manifests" {
+		t.Errorf("manifest dir is %s, want the config file's /srv/manifests", opts.ManifestDir)
+	}
+}
@@ -1,215 +1,226 @@
 package etcdutils
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
 	"text/template"
 	"time"
 )
 
-func Init(assetDir string) error {
-	if assetDir == "" {
-		assetDir = "."
-	}
+const (
+	kubeletService     = "kubelet.service"
+	kubeletStopTimeout = 2 * time.Minute
+)
+
+func Init(o *Options) error {
 	dirs := []string{"bin", "tmp", "shared", "backup", "templates", "restore", "manifests"}
 	for _, dir := range dirs {
-		err := os.Mkdir(assetDir+"/"+dir, os.ModePerm)
+		if _, err := o.fs().Stat(o.AssetPath(dir)); os.IsNotExist(err) && o.planned(ActionMkdir, o.AssetPath(dir), "") {
+			continue
+		}
+		err := o.fs().MkdirAll(o.AssetPath(dir), os.ModePerm)
 		if err != nil && !os.IsExist(err) {
-			log.Printf("Eroor creating dir %s: %v\n", dir, err)
+			log.Printf("Error creating dir %s: %v\n", dir, err)
 			return err
 		}
 	}
 	return nil
 }
 
-func BackupEtcdClientCerts(configFileDir, assetDir string) error {
-	backupDir := assetDir + "/backup"
-	if fileExists(backupDir+"/etcd-ca-bundle.crt") &&
-		fileExists(backupDir+"/etcd-client.crt") &&
-		fileExists(backupDir+"/etcd-client.key") {
+func BackupEtcdClientCerts(o *Options) error {
+	backupDir := o.BackupPath()
+	if etcdClientCertsBackedUp(o) {
 		log.Printf("etcd client certs already backed up and available %s\n", backupDir)
+		return nil
+	}
+	apiserverPodDir, ok := findEtcdClientCerts(o)
+	if !ok {
+		return fmt.Errorf("no etcd client certs found")
+	}
+	secretDir := apiserverPodDir + "/secrets/etcd-client"
+	configmapDir := apiserverPodDir + "/configmaps/etcd-serving-ca"
+	log.Printf("etcd client certs found in %s backing up to %s\n", apiserverPodDir, backupDir)
+	for _, f := range [][2]string{
+		{configmapDir + "/ca-bundle.crt", backupDir + "/etcd-ca-bundle.crt"},
+		{secretDir + "/tls.crt", backupDir + "/etcd-client.crt"},
+		{secretDir + "/tls.key", backupDir + "/etcd-client.key"},
+	} {
+		if err := copyFile(o, f[0], f[1]); err != nil {
+			return fmt.Errorf("could not back up %s (%v)", f[0], err)
+		}
 	}
-	if staticDirs, err := filepath.Glob(configFileDir + "/static-pod-resources/kube-apiserver-pod-[0-9]*"); err != nil {
+	return nil
+}
+
+func etcdClientCertsBackedUp(o *Options) bool {
+	return fileExists(o.fs(), o.BackupPath("etcd-ca-bundle.crt")) &&
+		fileExists(o.fs(), o.BackupPath("etcd-client.crt")) &&
+		fileExists(o.fs(), o.BackupPath("etcd-client.key"))
+}
+
+// findEtcdClientCerts returns the kube-apiserver static pod resource dir
+// that holds the etcd client certs.
+func findEtcdClientCerts(o *Options) (string, bool) {
+	if staticDirs, err := o.fs().Glob(o.KubernetesPath("static-pod-resources", "kube-apiserver-pod-[0-9]*")); err == nil {
 		for _, apiserverPodDir := range staticDirs {
 			secretDir := apiserverPodDir + "/secrets/etcd-client"
 			configmapDir := apiserverPodDir + "/configmaps/etcd-serving-ca"
-			if fileExists(configmapDir+"/ca-bundle.crt") &&
-				fileExists(secretDir+"/tls.crt") &&
-				fileExists(secretDir+"/tls.key") {
-				log.Printf("etcd client certs found in %s backing up to %s\n", apiserverPodDir, backupDir)
-				copyFile(configmapDir+"/ca-bundle.crt", backupDir+"/etcd-ca-bundle.crt")
-				copyFile(secretDir+"/tls.crt", backupDir+"/etcd-client.crt")
-				copyFile(secretDir+"/tls.key", backupDir+"/etcd-client.key")
-				return nil
-			} else {
-				log.Printf("%s does not contain etcd client certs, trying next ...\n", apiserverPodDir)
+			if fileExists(o.fs(), configmapDir+"/ca-bundle.crt") &&
+				fileExists(o.fs(), secretDir+"/tls.crt") &&
+				fileExists(o.fs(), secretDir+"/tls.key") {
+				return apiserverPodDir, true
 			}
+			log.Printf("%s does not contain etcd client certs, trying next ...\n", apiserverPodDir)
 		}
 	}
-	return fmt.Errorf("no etcd client certs found")
+	return "", false
 }
 
+// GenConfig prints the kubeconfig for params, which holds the base64
+// encoded CA, CERT and KEY and the RECOVERY_SERVER_IP and CLUSTER_NAME.
 func GenConfig(params map[string]string) error {
 	var err error
-	const configTemplate = `
-clusters:
-- cluster:
-    certificate-authority-data: {{.CA}}
-    server: https://{{.RECOVERY_SERVER_IP}}:9943
-  name: {{.CLUSTER_NAME}}
-contexts:
-- context:
-    cluster: {{.CLUSTER_NAME}}
-    user: kubelet
-  name: kubelet
-current-context: kubelet
-preferences: {}
-users:
-- name: kubelet
-  user:
-    client-certificate-data: {{.CERT}}
-    client-key-data: {{.KEY}}
-`
-	t := template.Must(template.New("config").Parse(configTemplate))
+	t := template.Must(template.New("config").Parse(kubeconfigTemplate))
 	if err = t.Execute(os.Stdout, params); err != nil {
 		log.Printf("Error executing template %v\n", err)
 	}
 	return err
 }
 
-func BackupManifest(manifestDir, assetDir string) error {
-	src := manifestDir + "etcd-member.yaml"
-	dst := assetDir + "/backup/" + "etcd-member.yaml"
-	if fileExists(dst) {
-		log.Printf("etcd-member.yaml already exists in %s/backup/\n", assetDir)
+func BackupManifest(o *Options) error {
+	src := o.EtcdManifest()
+	dst := o.BackupPath(o.EtcdManifestName)
+	if fileExists(o.fs(), dst) {
+		log.Printf("%s already exists in %s\n", o.EtcdManifestName, o.BackupPath())
 		return nil
 	}
 	log.Printf("Backing up %s to %s\n", src, dst)
-	return copyFile(src, dst)
+	return copyFile(o, src, dst)
 }
 
-func BackupEtcdConf(assetDir string) error {
-	src := "/etc/etcd/etcd.conf"
-	dst := assetDir + "/backup/" + "etcd.conf"
-	if fileExists(dst) {
-		log.Printf("etcd.conf backup upready exists in %s/backup/etcd.conf\n", assetDir)
+func BackupEtcdConf(o *Options) error {
+	src := o.EtcdConf()
+	dst := o.BackupPath("etcd.conf")
+	if fileExists(o.fs(), dst) {
+		log.Printf("etcd.conf backup already exists in %s\n", dst)
 		return nil
 	}
 	log.Printf("Backing up %s to %s\n", src, dst)
-	return copyFile(src, dst)
+	return copyFile(o, src, dst)
 }
 
-func BackupDataDir(etcdDataDir, assetDir string) error {
-	if fileExists(assetDir + "/backup/etcd/member/snap/db") {
-		log.Printf("etcd data-dir backup found %s/backup/etcd..\n", etcdDataDir)
-		return fmt.Errorf("data-dir backup is already found")
+func BackupDataDir(o *Options) error {
+	if fileExists(o.fs(), o.BackupPath("etcd", "member", "snap", "db")) {
+		log.Printf("etcd data-dir backup found %s..\n", o.BackupPath("etcd"))
+		return nil
 	}
-	if !fileExists(etcdDataDir + "/member/snap/db") {
+	if !fileExists(o.fs(), filepath.Join(o.DataDir(), "member", "snap", "db")) {
 		log.Printf("Local etcd snapshot file not found, backup skipped..\n")
-		return fmt.Errorf("Local etcd snapshot file not found, backup skipped..")
+		return nil
+	}
+	if err := copyDir(o, o.DataDir(), o.BackupPath("etcd")); err != nil {
+		// A partial backup would be taken for a complete one by a rerun.
+		removeAll(o, o.BackupPath("etcd"))
+		return fmt.Errorf("could not back up %s (%v)", o.DataDir(), err)
 	}
-	return copyDir(etcdDataDir, assetDir+"/backup/etcd")
+	return nil
 }
 
-func BackupCerts(etcdStaticResourceDir, assetDir string) {
-	if backupResources, _ := filepath.Glob(assetDir + "/backup/system:etcd-*"); len(backupResources) != 0 {
-		log.Printf("etcd TLS certificate backups found in %s/backup..\n", assetDir)
-	} else if staticResources, _ := filepath.Glob(etcdStaticResourceDir + "/system:etcd-*"); len(staticResources) != 0 {
+func BackupCerts(o *Options) error {
+	if backupResources, _ := o.fs().Glob(o.BackupPath("system:etcd-*")); len(backupResources) != 0 {
+		log.Printf("etcd TLS certificate backups found in %s..\n", o.BackupPath())
+	} else if staticResources, _ := o.fs().Glob(o.StaticResourcePath("system:etcd-*")); len(staticResources) != 0 {
 		log.Println("Backing up etcd certificates..")
 		for _, file := range staticResources {
-			copyFile(file, assetDir+"/backup/"+filepath.Base(file))
+			if err := copyFile(o, file, o.BackupPath(filepath.Base(file))); err != nil {
+				return fmt.Errorf("could not back up %s (%v)", file, err)
+			}
 		}
 	} else {
 		log.Printf("etcd TLS certificates not found, backup skipped..\n")
 	}
+	return nil
 }
 
-func StopEtcd(etcdManifest, manifestStoppedDir string) error {
-	checkAndCreateDir(manifestStoppedDir)
-	err := os.Rename(etcdManifest, manifestStoppedDir+"/etcd-member.yaml")
+// StopEtcd moves the etcd manifest out of the manifest dir and makes sure
+// the etcd containers are gone. Use WaitForEtcdStopped to wait for etcd to
+// release its ports.
+func StopEtcd(ctx context.Context, o *Options) error {
+	checkAndCreateDir(o, o.ManifestStoppedPath())
+	if !o.DryRun() && !fileExists(o.fs(), o.EtcdManifest()) && fileExists(o.fs(), o.StoppedEtcdManifest()) {
+		log.Printf("etcd manifest already moved to %s\n", o.ManifestStoppedPath())
+	} else if err := moveFile(o, o.EtcdManifest(), o.StoppedEtcdManifest()); err != nil {
+		return err
+	}
+	_, err := StopAllContainers(ctx, o, EtcdContainers)
 	return err
-	// Do we need to wait for stopped etcds?
 }
 
-func RemoveDataDir(dataDir string) error {
-	return os.RemoveAll(dataDir)
+func RemoveDataDir(o *Options) error {
+	return removeAll(o, o.DataDir())
 }
 
-func RemoveCerts(etcdStaticResourceDir string) {
-	if staticResources, _ := filepath.Glob(etcdStaticResourceDir + "/system:etcd-*"); len(staticResources) != 0 {
+func RemoveCerts(o *Options) {
+	if staticResources, _ := o.fs().Glob(o.StaticResourcePath("system:etcd-*")); len(staticResources) != 0 {
 		for _, file := range staticResources {
-			os.RemoveAll(file)
+			removeAll(o, file)
 		}
 	}
 }
 
-func PatchManifest(manifestFilePath, old, new string) {
-
-	read, err := ioutil.ReadFile(manifestFilePath)
-	if err != nil {
-		log.Printf("%s:read error %v\n", manifestFilePath, err)
-	}
-	log.Println(manifestFilePath)
-
-	newContents := strings.Replace(string(read), old, new, -1)
-
-	if err := ioutil.WriteFile(manifestFilePath, []byte(newContents), 0); err != nil {
-		log.Printf("%s:write error %s\n", manifestFilePath, err)
-	}
-}
-
-func StartEtcd(etcdManifest, manifestStoppedDir string) error {
+func StartEtcd(o *Options) error {
 	log.Printf("Starting etcd..\n")
-	return os.Rename(manifestStoppedDir+"/etcd-member.yaml", etcdManifest)
-}
-
-func PopulateTemplate() {
-	// Should use golang template format
+	if !o.DryRun() && fileExists(o.fs(), o.EtcdManifest()) && !fileExists(o.fs(), o.StoppedEtcdManifest()) {
+		log.Printf("etcd manifest already in place at %s\n", o.EtcdManifest())
+		return nil
+	}
+	return moveFile(o, o.StoppedEtcdManifest(), o.EtcdManifest())
 }
 
-func StartCertRecover(etcdManifest, manifestStoppedDir string) error {
+func StartCertRecover(o *Options) error {
 	log.Printf("Starting etcd client cert recovery agent..\n")
-	return os.Rename(manifestStoppedDir+"/etcd-generate-certs.yaml", etcdManifest)
+	return moveFile(o, o.ManifestStoppedPath("etcd-generate-certs.yaml"), o.ManifestPath("etcd-generate-certs.yaml"))
 }
 
-func VerifyCerts(etcdStaticResourceDir string) {
-	staticResources, _ := filepath.Glob(etcdStaticResourceDir + "/system:etcd-*")
+func VerifyCerts(o *Options) {
+	staticResources, _ := o.fs().Glob(o.StaticResourcePath("system:etcd-*"))
 	for len(staticResources) < 9 {
 		log.Printf("Waiting for certs to generate...\n")
 		time.Sleep(10 * time.Second)
-		staticResources, _ = filepath.Glob(etcdStaticResourceDir + "/system:etcd-*")
+		staticResources, _ = o.fs().Glob(o.StaticResourcePath("system:etcd-*"))
 	}
 }
 
-func StopCertRecover(etcdManifest, manifestStoppedDir string) error {
+func StopCertRecover(o *Options) error {
 	log.Printf("Stopping etcd client cert recovery agent..\n")
-	return os.Rename(etcdManifest, manifestStoppedDir+"/etcd-generate-certs.yaml")
+	return moveFile(o, o.ManifestPath("etcd-generate-certs.yaml"), o.ManifestStoppedPath("etcd-generate-certs.yaml"))
 }
 
-func StopStaticPods(etcdManifest, manifestStoppedDir string) error {
-	checkAndCreateDir(manifestStoppedDir)
-	if fds, err := ioutil.ReadDir(etcdManifest); err == nil {
+// StopStaticPods moves all static pod manifests out of the manifest dir and
+// makes sure the etcd and kube-apiserver containers are gone.
+func StopStaticPods(ctx context.Context, o *Options) error {
+	checkAndCreateDir(o, o.ManifestStoppedPath())
+	if fds, err := o.fs().ReadDir(o.ManifestPath()); err == nil {
 		for _, fd := range fds {
 			if !fd.IsDir() {
-				os.Rename(etcdManifest+fd.Name(), manifestStoppedDir+fd.Name())
+				moveFile(o, o.ManifestPath(fd.Name()), o.ManifestStoppedPath(fd.Name()))
 			}
 		}
 	} else {
 		return err
 	}
-	return nil
+	_, err := StopAllContainers(ctx, o, EtcdContainers, KubeAPIServerContainers)
+	return err
 }
 
-func StartStaticPods(etcdManifest, manifestStoppedDir string) error {
-	if fds, err := ioutil.ReadDir(manifestStoppedDir); err == nil {
+func StartStaticPods(o *Options) error {
+	if fds, err := o.fs().ReadDir(o.ManifestStoppedPath()); err == nil {
 		for _, fd := range fds {
 			if !fd.IsDir() {
-				os.Rename(manifestStoppedDir+fd.Name(), etcdManifest+fd.Name())
+				moveFile(o, o.ManifestStoppedPath(fd.Name()), o.ManifestPath(fd.Name()))
 			}
 		}
 	} else {
@@ -218,25 +229,27 @@ func StartStaticPods(etcdManifest, manifestStoppedDir string) error {
 	return nil
 }
 
-func StopKubelet() error {
+// StopKubelet stops kubelet.service and waits until it is no longer active.
+func StopKubelet(ctx context.Context, o *Options) error {
 	log.Println("Stopping kubelet..")
-	cmd := exec.Command("systemctl", "stop", "kubelet.service")
-	return cmd.Run()
+	if o.planned(ActionStopService, kubeletService, "") {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, kubeletStopTimeout)
+	defer cancel()
+	if err := o.services().Stop(ctx, kubeletService); err != nil {
+		return err
+	}
+	return waitForInactive(ctx, o.services(), kubeletService)
 }
 
-func StartKubelet() error {
+func StartKubelet(ctx context.Context, o *Options) error {
 	log.Println("Starting kubelet..")
-	cmd := exec.Command("systemctl", "daemon-reload")
-	cmd.Run()
-	cmd = exec.Command("systemctl", "start", "kubelet.service")
-	return cmd.Run()
-}
-
-func StopAllContainers() {
-}
-
-func ValidateEnvironment() {
-}
-
-func ValidateEtcdName() {
+	if o.planned(ActionStartService, kubeletService, "after systemctl daemon-reload") {
+		return nil
+	}
+	if err := o.services().Reload(ctx); err != nil {
+		return err
+	}
+	return o.services().Start(ctx, kubeletService)
 }
@@ -0,0 +1,282 @@
+package etcdutils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	memberCertValidity = 3 * 365 * 24 * time.Hour
+	memberKeyBits      = 2048
+)
+
+// etcdServiceNames are the in-cluster names of etcd put into the server and
+// metric certs.
+var etcdServiceNames = []string{
+	"localhost",
+	"etcd.kube-system.svc",
+	"etcd.kube-system.svc.cluster.local",
+	"etcd.openshift-etcd.svc",
+	"etcd.openshift-etcd.svc.cluster.local",
+}
+
+// CertAuthority signs certs with a CA key loaded from disk.
+type CertAuthority struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// LoadCertAuthority reads the PEM encoded CA cert and key at certPath and
+// keyPath, which are resolved below o.Root, and checks that they belong
+// together.
+func LoadCertAuthority(o *Options, certPath, keyPath string) (*CertAuthority, error) {
+	certPath, keyPath = o.resolve(certPath), o.resolve(keyPath)
+	certPEM, err := readFile(o.fs(), certPath)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertsPEM(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse CA cert %s (%v)", certPath, err)
+	}
+	keyPEM, err := readFile(o.fs(), keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse CA key %s (%v)", keyPath, err)
+	}
+	if !certs[0].IsCA {
+		return nil, fmt.Errorf("%s is not a CA cert", certPath)
+	}
+	if _, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return nil, fmt.Errorf("CA key %s does not match %s (%v)", keyPath, certPath, err)
+	}
+	return &CertAuthority{Cert: certs[0], Key: key}, nil
+}
+
+// Sign issues a cert for pub from tmpl, valid from now for validity, and
+// returns it PEM encoded.
+func (ca *CertAuthority) Sign(tmpl *x509.Certificate, pub crypto.PublicKey, validity time.Duration) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-5 * time.Minute)
+	tmpl.NotAfter = time.Now().Add(validity)
+	if tmpl.NotAfter.After(ca.Cert.NotAfter) {
+		tmpl.NotAfter = ca.Cert.NotAfter
+	}
+	tmpl.BasicConstraintsValid = true
+	tmpl.IsCA = false
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, pub, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no private key found")
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			switch key := key.(type) {
+			case *rsa.PrivateKey:
+				return key, nil
+			case *ecdsa.PrivateKey:
+				return key, nil
+			}
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+	}
+}
+
+// MemberCertParams identify the member GenerateMemberCerts issues certs for.
+type MemberCertParams struct {
+	// DNSName is the member's name in the discovery domain, e.g.
+	// etcd-0.cluster.example.com, which the certs are named after.
+	DNSName         string
+	DiscoveryDomain string
+	IPs             []string
+	// CACert and CAKey are the paths of the etcd signer on the node.
+	CACert string
+	CAKey  string
+}
+
+// memberCert is one of the certs of a member, named system:etcd-<kind>:<dns>.
+type memberCert struct {
+	kind     string
+	org      string
+	dnsNames []string
+	ips      []string
+}
+
+func (p MemberCertParams) certs() []memberCert {
+	serverNames := append(append([]string{}, etcdServiceNames...), p.DNSName)
+	peerNames := []string{p.DNSName}
+	if p.DiscoveryDomain != "" {
+		peerNames = append(peerNames, p.DiscoveryDomain)
+	}
+	return []memberCert{
+		{"peer", "system:etcd-peers", peerNames, p.IPs},
+		{"server", "system:etcd-servers", serverNames, append(append([]string{}, p.IPs...), "127.0.0.1")},
+		{"metric", "system:etcd-metrics", serverNames, p.IPs},
+	}
+}
+
+// GenerateMemberCerts writes the peer, server and metric certs of a member
+// and their keys to the static resource dir, signed by the CA in p. Certs
+// that exist already along with their key are kept, unless they are expired,
+// not yet valid, not signed by the CA, do not match their key or were
+// issued for other names or IPs than p asks for.
+func GenerateMemberCerts(o *Options, p MemberCertParams) error {
+	if p.DNSName == "" || len(p.IPs) == 0 {
+		return fmt.Errorf("member DNS name and IPs must be set")
+	}
+	var ips []net.IP
+	for _, s := range p.IPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %q", s)
+		}
+		ips = append(ips, ip)
+	}
+	ca, err := LoadCertAuthority(o, p.CACert, p.CAKey)
+	if err != nil {
+		return err
+	}
+	if !o.DryRun() {
+		if err = o.fs().MkdirAll(o.StaticResourcePath(), 0755); err != nil {
+			return err
+		}
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	for _, c := range p.certs() {
+		cn := fmt.Sprintf("system:etcd-%s:%s", c.kind, p.DNSName)
+		certPath, keyPath := o.StaticResourcePath(cn+".crt"), o.StaticResourcePath(cn+".key")
+		if fileExists(o.fs(), certPath) && fileExists(o.fs(), keyPath) {
+			info := inspectCert(o, certPath, keyPath, roots, time.Now())
+			if problem := c.sanMismatch(info.SANs); problem != "" {
+				info.Status = CheckFail
+				info.Problems = append(info.Problems, problem)
+			}
+			if info.Status != CheckFail {
+				log.Printf("%s already exists, not regenerated\n", certPath)
+				continue
+			}
+			log.Printf("Regenerating %s: %s\n", certPath, strings.Join(info.Problems, "; "))
+		}
+		if o.planned(ActionWrite, certPath, "sign "+cn+" with "+ca.Cert.Subject.CommonName) {
+			continue
+		}
+
+		key, err := rsa.GenerateKey(rand.Reader, memberKeyBits)
+		if err != nil {
+			return err
+		}
+		tmpl := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: cn, Organization: []string{c.org}},
+			DNSNames:    c.dnsNames,
+			KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		for _, s := range c.ips {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(s))
+		}
+		certPEM, err := ca.Sign(tmpl, &key.PublicKey, memberCertValidity)
+		if err != nil {
+			return fmt.Errorf("could not sign %s (%v)", cn, err)
+		}
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+		log.Printf("Writing %s..\n", certPath)
+		if err = writeKeyPair(o.fs(), certPath, certPEM, keyPath, keyPEM); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sanMismatch describes how the SANs of an existing cert differ from those
+// c is issued with, or returns "" if they are the same.
+func (c memberCert) sanMismatch(sans []string) string {
+	want := append([]string{}, c.dnsNames...)
+	for _, s := range c.ips {
+		want = append(want, net.ParseIP(s).String())
+	}
+	have := map[string]bool{}
+	for _, s := range sans {
+		have[s] = true
+	}
+	var missing []string
+	for _, s := range want {
+		if !have[s] {
+			missing = append(missing, s)
+		}
+		delete(have, s)
+	}
+	var extra []string
+	for s := range have {
+		extra = append(extra, s)
+	}
+	sort.Strings(extra)
+	switch {
+	case len(missing) != 0 && len(extra) != 0:
+		return fmt.Sprintf("SANs lack %s and have %s", strings.Join(missing, ", "), strings.Join(extra, ", "))
+	case len(missing) != 0:
+		return fmt.Sprintf("SANs lack %s", strings.Join(missing, ", "))
+	case len(extra) != 0:
+		return fmt.Sprintf("SANs have %s", strings.Join(extra, ", "))
+	}
+	return ""
+}
+
+// writeKeyPair writes a cert and its key next to their final paths first
+// and only then moves both into place, so a failed write never pairs a new
+// key with the old cert.
+func writeKeyPair(fs FS, certPath string, certPEM []byte, keyPath string, keyPEM []byte) error {
+	certNew, keyNew := certPath+".new", keyPath+".new"
+	err := writeFileAtomic(fs, keyNew, keyPEM, 0600)
+	if err == nil {
+		err = writeFileAtomic(fs, certNew, certPEM, 0600)
+	}
+	if err == nil {
+		err = fs.Rename(keyNew, keyPath)
+	}
+	if err != nil {
+		fs.Remove(keyNew)
+		fs.Remove(certNew)
+		return err
+	}
+	return fs.Rename(certNew, certPath)
+}
@@ -0,0 +1,176 @@
+package etcdutils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// certExpiryWarning is how long before expiry a cert is reported.
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// CertInfo describes a cert found on the node. Status is CheckFail if the
+// cert is not valid now, does not chain to the CA bundle or its key does
+// not match, and CheckWarn if it expires soon.
+type CertInfo struct {
+	Path      string    `json:"path"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	SANs      []string  `json:"sans"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	DaysLeft  int       `json:"daysLeft"`
+	Status    string    `json:"status"`
+	Problems  []string  `json:"problems,omitempty"`
+}
+
+// CertReport is the list of certs inspected by InspectCerts.
+type CertReport []CertInfo
+
+// Failed reports whether any cert is unusable.
+func (r CertReport) Failed() bool {
+	for _, c := range r {
+		if c.Status == CheckFail {
+			return true
+		}
+	}
+	return false
+}
+
+func (r CertReport) Print(w io.Writer) {
+	for _, c := range r {
+		fmt.Fprintf(w, "[%s] %s\n", c.Status, c.Path)
+		if c.Subject != "" {
+			fmt.Fprintf(w, "       subject: %s\n", c.Subject)
+			fmt.Fprintf(w, "       issuer:  %s\n", c.Issuer)
+			fmt.Fprintf(w, "       SANs:    %s\n", strings.Join(c.SANs, ", "))
+			fmt.Fprintf(w, "       valid:   %s to %s (%d days left)\n",
+				c.NotBefore.UTC().Format(time.RFC3339), c.NotAfter.UTC().Format(time.RFC3339), c.DaysLeft)
+		}
+		for _, p := range c.Problems {
+			fmt.Fprintf(w, "       problem: %s\n", p)
+		}
+	}
+}
+
+// InspectCerts parses the system:etcd-* certs in the static resource dir
+// and the client cert, and checks each against the CA bundle of client and
+// the key stored next to it.
+func InspectCerts(o *Options, client ClientTLSFiles) (CertReport, error) {
+	roots := x509.NewCertPool()
+	caPEM, err := readFile(o.fs(), client.CACert)
+	if err != nil {
+		return nil, err
+	}
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no CA certs found in %s", client.CACert)
+	}
+	if data, err := readFile(o.fs(), o.StaticResourcePath("ca.crt")); err == nil {
+		roots.AppendCertsFromPEM(data)
+	}
+
+	type pair struct{ cert, key string }
+	var pairs []pair
+	certs, _ := o.fs().Glob(o.StaticResourcePath("system:etcd-*.crt"))
+	for _, cert := range certs {
+		pairs = append(pairs, pair{cert, strings.TrimSuffix(cert, ".crt") + ".key"})
+	}
+	pairs = append(pairs, pair{client.Cert, client.Key})
+
+	var r CertReport
+	for _, p := range pairs {
+		r = append(r, inspectCert(o, p.cert, p.key, roots, time.Now()))
+	}
+	return r, nil
+}
+
+func inspectCert(o *Options, certPath, keyPath string, roots *x509.CertPool, now time.Time) CertInfo {
+	info := CertInfo{Path: certPath, Status: CheckPass}
+	fail := func(format string, args ...interface{}) {
+		info.Status = CheckFail
+		info.Problems = append(info.Problems, fmt.Sprintf(format, args...))
+	}
+
+	certPEM, err := readFile(o.fs(), certPath)
+	if err != nil {
+		fail("%v", err)
+		return info
+	}
+	chain, err := parseCertsPEM(certPEM)
+	if err != nil {
+		fail("%v", err)
+		return info
+	}
+	cert := chain[0]
+	info.Subject = cert.Subject.String()
+	info.Issuer = cert.Issuer.String()
+	info.SANs = append(info.SANs, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+	info.NotBefore, info.NotAfter = cert.NotBefore, cert.NotAfter
+	info.DaysLeft = int(cert.NotAfter.Sub(now).Hours() / 24)
+
+	switch {
+	case now.Before(cert.NotBefore):
+		fail("not valid before %s", cert.NotBefore.UTC().Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		fail("expired %d days ago", -info.DaysLeft)
+	case cert.NotAfter.Sub(now) < certExpiryWarning:
+		info.Status = CheckWarn
+		info.Problems = append(info.Problems, fmt.Sprintf("expires in %d days", info.DaysLeft))
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if invalid, ok := err.(x509.CertificateInvalidError); ok && invalid.Reason == x509.Expired && invalid.Cert == cert {
+		err = nil // already reported
+	}
+	if err != nil {
+		fail("does not chain to the CA bundle: %v", err)
+	}
+
+	keyPEM, err := readFile(o.fs(), keyPath)
+	if err != nil {
+		fail("%v", err)
+	} else if _, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		fail("key %s does not match: %v", keyPath, err)
+	}
+	return info
+}
+
+// parseCertsPEM returns the certs of a PEM bundle in order.
+func parseCertsPEM(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return certs, nil
+}
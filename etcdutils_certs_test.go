@@ -0,0 +1,142 @@
+package etcdutils
+
+import (
+	"crypto/x509"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInspectCerts(t *testing.T) {
+	o := newTestMaster(t)
+	fs := o.FS.(*MemFS)
+	ca := newTestCert(t, nil, "etcd-signer")
+	other := newTestCert(t, nil, "other-signer")
+	peer := newTestCert(t, ca, "system:etcd-peer:master-0")
+	server := newTestCert(t, other, "system:etcd-server:master-0")
+	client := newTestCert(t, ca, "etcd")
+
+	files := map[string][]byte{
+		o.StaticResourcePath("system:etcd-peer:master-0.crt"):   peer.certPEM,
+		o.StaticResourcePath("system:etcd-peer:master-0.key"):   peer.keyPEM,
+		o.StaticResourcePath("system:etcd-server:master-0.crt"): server.certPEM,
+		o.StaticResourcePath("system:etcd-server:master-0.key"): server.keyPEM,
+		o.BackupPath("etcd-ca-bundle.crt"):                      ca.certPEM,
+		o.BackupPath("etcd-client.crt"):                         client.certPEM,
+		o.BackupPath("etcd-client.key"):                         peer.keyPEM,
+	}
+	for name, data := range files {
+		if err := fs.WriteFile(name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := InspectCerts(o, EtcdClientTLSFiles(o))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := map[string]string{}
+	for _, c := range report {
+		status[c.Path] = c.Status
+	}
+	want := map[string]string{
+		o.StaticResourcePath("system:etcd-peer:master-0.crt"):   CheckWarn, // expires within a day
+		o.StaticResourcePath("system:etcd-server:master-0.crt"): CheckFail,
+		o.BackupPath("etcd-client.crt"):                         CheckFail,
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("statuses = %v, want %v", status, want)
+	}
+	if !report.Failed() {
+		t.Error("report does not fail")
+	}
+	if report[0].DaysLeft != 0 || report[0].Subject != "CN=system:etcd-peer:master-0" {
+		t.Errorf("unexpected cert info %+v", report[0])
+	}
+}
+
+func TestGenerateMemberCerts(t *testing.T) {
+	o := newTestMaster(t)
+	fs := o.FS.(*MemFS)
+	ca := newTestCert(t, nil, "etcd-signer")
+	fs.WriteFile("/signer/ca.crt", ca.certPEM, 0600)
+	fs.WriteFile("/signer/ca.key", ca.keyPEM, 0600)
+	fs.WriteFile(o.BackupPath("etcd-ca-bundle.crt"), ca.certPEM, 0600)
+	client := newTestCert(t, ca, "etcd")
+	fs.WriteFile(o.BackupPath("etcd-client.crt"), client.certPEM, 0600)
+	fs.WriteFile(o.BackupPath("etcd-client.key"), client.keyPEM, 0600)
+	fs.Remove(o.StaticResourcePath("system:etcd-peer:master-0.crt"))
+
+	p := MemberCertParams{
+		DNSName:         "etcd-0.cluster.example.com",
+		DiscoveryDomain: "cluster.example.com",
+		IPs:             []string{"10.0.0.1"},
+		CACert:          "/signer/ca.crt",
+		CAKey:           "/signer/ca.key",
+	}
+	if err := GenerateMemberCerts(o, p); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := InspectCerts(o, EtcdClientTLSFiles(o))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 4 {
+		t.Fatalf("inspected %d certs, want 3 member certs and the client cert", len(report))
+	}
+	sans := map[string][]string{}
+	for _, c := range report[:3] {
+		if len(c.Problems) != 0 && c.Status != CheckWarn {
+			t.Errorf("%s: %v", c.Path, c.Problems)
+		}
+		sans[c.Subject] = c.SANs
+	}
+	peer := sans["CN=system:etcd-peer:etcd-0.cluster.example.com,O=system:etcd-peers"]
+	if !reflect.DeepEqual(peer, []string{"etcd-0.cluster.example.com", "cluster.example.com", "10.0.0.1"}) {
+		t.Errorf("peer SANs = %v", peer)
+	}
+	server := sans["CN=system:etcd-server:etcd-0.cluster.example.com,O=system:etcd-servers"]
+	if len(server) == 0 || server[len(server)-1] != "127.0.0.1" {
+		t.Errorf("server SANs = %v", server)
+	}
+
+	key, _ := readFile(fs, o.StaticResourcePath("system:etcd-peer:etcd-0.cluster.example.com.key"))
+	if err = GenerateMemberCerts(o, p); err != nil {
+		t.Fatal(err)
+	}
+	again, _ := readFile(fs, o.StaticResourcePath("system:etcd-peer:etcd-0.cluster.example.com.key"))
+	if string(key) != string(again) {
+		t.Error("existing member cert was regenerated")
+	}
+
+	other := newTestCert(t, nil, "other-signer")
+	foreign := newTestCert(t, other, "system:etcd-peer:etcd-0.cluster.example.com")
+	fs.WriteFile(o.StaticResourcePath("system:etcd-peer:etcd-0.cluster.example.com.crt"), foreign.certPEM, 0600)
+	fs.WriteFile(o.StaticResourcePath("system:etcd-peer:etcd-0.cluster.example.com.key"), foreign.keyPEM, 0600)
+	if err = GenerateMemberCerts(o, p); err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	info := inspectCert(o, o.StaticResourcePath("system:etcd-peer:etcd-0.cluster.example.com.crt"),
+		o.StaticResourcePath("system:etcd-peer:etcd-0.cluster.example.com.key"), roots, time.Now())
+	if info.Status == CheckFail {
+		t.Errorf("cert signed by another CA was kept: %v", info.Problems)
+	}
+
+	p.IPs = []string{"10.0.0.2"}
+	if err = GenerateMemberCerts(o, p); err != nil {
+		t.Fatal(err)
+	}
+	info = inspectCert(o, o.StaticResourcePath("system:etcd-peer:etcd-0.cluster.example.com.crt"),
+		o.StaticResourcePath("system:etcd-peer:etcd-0.cluster.example.com.key"), roots, time.Now())
+	if want := []string{"etcd-0.cluster.example.com", "cluster.example.com", "10.0.0.2"}; !reflect.DeepEqual(info.SANs, want) {
+		t.Errorf("peer SANs after changing the IP = %v, want %v", info.SANs, want)
+	}
+
+	fs.WriteFile("/signer/ca.key", other.keyPEM, 0600)
+	if _, err = LoadCertAuthority(o, "/signer/ca.crt", "/signer/ca.key"); err == nil {
+		t.Error("CA with a mismatching key loaded")
+	}
+}
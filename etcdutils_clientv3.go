@@ -2,53 +2,123 @@ package etcdutils
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
-	"github.com/coreos/etcd/pkg/fileutil"
 	"github.com/coreos/etcd/clientv3"
-	"github.com/coreos/etcd/embed"
 	"github.com/coreos/etcd/clientv3/snapshot"
+	"github.com/coreos/etcd/embed"
+	"github.com/coreos/etcd/pkg/fileutil"
 	"go.uber.org/zap"
 )
 
-func SaveSnapshot(ctx context.Context, cfg clientv3.Config, dbPath string) error {
-	if len(cfg.Endpoints) != 1 {
-		return fmt.Errorf("snapshot must be requested to one selected node, not multiple %#v", cfg.Endpoints)
+// SnapshotStdout as the path of SaveSnapshot streams the snapshot to
+// stdout, without metadata.
+const SnapshotStdout = "-"
+
+// SaveSnapshot streams a snapshot to dbPath, resolved below the root of o
+// and written through its FS, compressed as set in opts, verifies its hash
+// and writes its metadata, including the endpoint it came from, to
+// dbPath + ".json".
+// With several endpoints the snapshot is taken from the best one as ranked
+// by selectSnapshotEndpoints, and from the next one if that fails before
+// anything was streamed to stdout.
+func SaveSnapshot(ctx context.Context, o *Options, cfg clientv3.Config, dbPath string, opts SnapshotOptions) error {
+	if len(cfg.Endpoints) == 0 {
+		return fmt.Errorf("no endpoint to request a snapshot from")
+	}
+	if _, err := newSnapshotWriter(ioutil.Discard, opts); err != nil {
+		return err
+	}
+	if dbPath != SnapshotStdout {
+		dbPath = o.resolve(dbPath)
+	}
+	if o.planned(ActionEtcdAPI, "Snapshot", fmt.Sprintf("from one of %v saved to %s", cfg.Endpoints, dbPath)) {
+		return nil
+	}
+	endpoints := cfg.Endpoints
+	if len(endpoints) > 1 {
+		var err error
+		if endpoints, err = selectSnapshotEndpoints(ctx, cfg); err != nil {
+			return err
+		}
+	}
+
+	var errs []string
+	for _, ep := range endpoints {
+		epCfg := cfg
+		epCfg.Endpoints = []string{ep}
+		streamed, err := saveSnapshotFrom(ctx, o.fs(), epCfg, dbPath, opts)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Snapshot from %s failed: %v\n", ep, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", ep, err))
+		if ctx.Err() != nil || (streamed && dbPath == SnapshotStdout) {
+			break
+		}
 	}
+	return fmt.Errorf("could not save snapshot: %s", strings.Join(errs, "; "))
+}
+
+// saveSnapshotFrom saves a snapshot from cfg.Endpoints[0] and reports
+// whether anything was written to dbPath.
+func saveSnapshotFrom(ctx context.Context, fs FS, cfg clientv3.Config, dbPath string, opts SnapshotOptions) (bool, error) {
 	cli, err := clientv3.New(cfg)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer cli.Close()
 
-	partpath := dbPath + ".part"
-	defer os.RemoveAll(partpath)
-
-	var f *os.File
-	f, err = os.OpenFile(partpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileutil.PrivateFileMode)
+	status, err := cli.Status(ctx, cfg.Endpoints[0])
 	if err != nil {
-		return fmt.Errorf("could not open %s (%v)", partpath, err)
+		return false, err
+	}
+	keys, err := cli.Get(ctx, "\x00", clientv3.WithFromKey(), clientv3.WithCountOnly())
+	if err != nil {
+		return false, err
+	}
+
+	out := &countingWriter{w: os.Stdout}
+	partpath := dbPath + ".part"
+	var f File
+	if dbPath != SnapshotStdout {
+		defer fs.RemoveAll(partpath)
+		f, err = fs.OpenFile(partpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileutil.PrivateFileMode)
+		if err != nil {
+			return false, fmt.Errorf("could not open %s (%v)", partpath, err)
+		}
+		defer f.Close()
+		out.w = f
 	}
 
 	now := time.Now()
-	var rd io.ReadCloser
-	rd, err = cli.Snapshot(ctx)
+	rd, err := cli.Snapshot(ctx)
 	if err != nil {
-		return err
+		return false, err
 	}
+	defer rd.Close()
 
-	if _, err = io.Copy(f, rd); err != nil {
-		return err
+	digest := sha256.New()
+	zw, err := newSnapshotWriter(io.MultiWriter(out, digest), opts)
+	if err != nil {
+		return false, err
 	}
-	if err = fileutil.Fsync(f); err != nil {
-		return err
+	hw := newSnapshotHashWriter()
+	if _, err = io.Copy(io.MultiWriter(zw, hw), rd); err != nil {
+		return out.n > 0, err
 	}
-	if err = f.Close(); err != nil {
-		return err
+	if err = zw.Close(); err != nil {
+		return true, err
 	}
 	log.Println(
 		"fetched snapshot",
@@ -56,27 +126,192 @@ func SaveSnapshot(ctx context.Context, cfg clientv3.Config, dbPath string) error
 		"took", time.Since(now),
 	)
 
-	if err = os.Rename(partpath, dbPath); err != nil {
-		return fmt.Errorf("could not rename %s to %s (%v)", partpath, dbPath, err)
+	hasHash, err := hw.check()
+	if err != nil {
+		return true, fmt.Errorf("snapshot from %s is corrupt: %v", cfg.Endpoints[0], err)
+	}
+	if !hasHash {
+		log.Printf("snapshot from %s has no integrity hash\n", cfg.Endpoints[0])
+	}
+	if dbPath == SnapshotStdout {
+		return true, nil
+	}
+
+	if err = f.Sync(); err != nil {
+		return true, err
+	}
+	if err = f.Close(); err != nil {
+		return true, err
+	}
+	if err = fs.Rename(partpath, dbPath); err != nil {
+		return true, fmt.Errorf("could not rename %s to %s (%v)", partpath, dbPath, err)
 	}
 	log.Println("saved snapshot to path", dbPath)
-	return nil
+
+	return true, writeSnapshotMetadata(fs, dbPath, &SnapshotMetadata{
+		Endpoint:    cfg.Endpoints[0],
+		MemberID:    fmt.Sprintf("%x", status.Header.MemberId),
+		ClusterID:   fmt.Sprintf("%x", status.Header.ClusterId),
+		Revision:    status.Header.Revision,
+		RaftTerm:    status.RaftTerm,
+		TotalKeys:   keys.Count,
+		Size:        out.n,
+		DBSize:      hw.n,
+		Compression: opts.Compression,
+		Encrypted:   opts.Key != nil,
+		SHA256:      hex.EncodeToString(digest.Sum(nil)),
+		Timestamp:   now.UTC(),
+	})
+}
+
+// endpointStatus is what selectSnapshotEndpoints ranks an endpoint by.
+type endpointStatus struct {
+	endpoint  string
+	leader    bool
+	raftIndex uint64
 }
 
-func RestoreSnapshot(ctx context.Context, cfg embed.Config, peerURLs []string, dbPath string) error {
+// selectSnapshotEndpoints returns the endpoints of cfg that report their
+// status, best snapshot source first: followers before the leader, which
+// is spared the load, and the most up to date follower first. Followers
+// are ranked by their raft index, which is the committed index: the Status
+// of etcd v3.3 does not report the applied index.
+func selectSnapshotEndpoints(ctx context.Context, cfg clientv3.Config) ([]string, error) {
+	cli, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	timeout := cfg.DialTimeout
+	if timeout == 0 {
+		timeout = etcdStatusTimeout
+	}
+	var statuses []endpointStatus
+	for _, ep := range cfg.Endpoints {
+		statusCtx, cancel := context.WithTimeout(ctx, timeout)
+		resp, err := cli.Status(statusCtx, ep)
+		cancel()
+		if err != nil {
+			log.Printf("Skipping endpoint %s: %v\n", ep, err)
+			continue
+		}
+		statuses = append(statuses, endpointStatus{
+			endpoint:  ep,
+			leader:    resp.Leader == resp.Header.MemberId,
+			raftIndex: resp.RaftIndex,
+		})
+	}
+	if len(statuses) == 0 {
+		return nil, fmt.Errorf("none of the endpoints %v is reachable", cfg.Endpoints)
+	}
+	return rankEndpoints(statuses), nil
+}
+
+func rankEndpoints(statuses []endpointStatus) []string {
+	sort.SliceStable(statuses, func(i, j int) bool {
+		if statuses[i].leader != statuses[j].leader {
+			return !statuses[i].leader
+		}
+		return statuses[i].raftIndex > statuses[j].raftIndex
+	})
+	endpoints := make([]string, len(statuses))
+	for i, s := range statuses {
+		endpoints[i] = s.endpoint
+	}
+	return endpoints
+}
+
+// RestoreSnapshot restores the snapshot at dbPath into cfg.Dir. The data is
+// restored into a temporary sibling directory first and only swapped into
+// place once the restore has succeeded, so a failed restore never leaves a
+// half-written data-dir behind. An existing data-dir is kept as cfg.Dir + ".old".
+// Snapshots that fail VerifySnapshot are refused unless skipHashCheck is set.
+// Gzip and zstd compressed snapshots are detected and decompressed first,
+// encrypted ones are decrypted with key.
+// dbPath is resolved below the root of o, cfg.Dir is taken as resolved
+// already, like o.DataDir(). The snapshot is read and the data-dir swapped
+// through the FS of o, but etcd writes the restored member to the host, so
+// o must use a host FS.
+func RestoreSnapshot(ctx context.Context, o *Options, cfg embed.Config, peerURLs []string, dbPath string, skipHashCheck bool, key *SnapshotKey) error {
+	if cfg.Dir == "" {
+		return fmt.Errorf("data-dir must be specified for restore")
+	}
+	if len(peerURLs) == 0 {
+		for _, u := range cfg.APUrls {
+			peerURLs = append(peerURLs, u.String())
+		}
+	}
+	dataDir := filepath.Clean(cfg.Dir)
+	dbPath = o.resolve(dbPath)
+	fs := o.fs()
+	if err := verifySnapshot(fs, dbPath, key); err != nil {
+		if !skipHashCheck {
+			return err
+		}
+		log.Printf("Restoring unverified snapshot: %v\n", err)
+	}
+	if o.planned(ActionWrite, dataDir, "restore snapshot "+dbPath+" as member "+cfg.Name) {
+		return nil
+	}
+	tmpDir := dataDir + ".restore.tmp"
+	oldDir := dataDir + ".old"
+
+	if err := fs.RemoveAll(tmpDir); err != nil {
+		return fmt.Errorf("could not remove stale restore dir %s (%v)", tmpDir, err)
+	}
+	// Decode next to the data-dir, where there is room for the db anyway.
+	rawPath, cleanup, err := decodeSnapshot(fs, dbPath, filepath.Dir(dataDir), key)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
 	sp := snapshot.NewV3(zap.NewExample())
-	return sp.Restore(snapshot.RestoreConfig{
-		SnapshotPath:        dbPath,
+	err = sp.Restore(snapshot.RestoreConfig{
+		SnapshotPath:        rawPath,
 		Name:                cfg.Name,
-		OutputDataDir:       cfg.Dir,
+		OutputDataDir:       tmpDir,
 		PeerURLs:            peerURLs,
 		InitialCluster:      cfg.InitialCluster,
 		InitialClusterToken: cfg.InitialClusterToken,
+		SkipHashCheck:       skipHashCheck,
 	})
+	if err != nil {
+		fs.RemoveAll(tmpDir)
+		return err
+	}
+
+	movedOld := false
+	if _, err = fs.Stat(dataDir); err == nil {
+		if _, err = fs.Stat(oldDir); err == nil {
+			fs.RemoveAll(tmpDir)
+			return fmt.Errorf("previous data-dir backup %s already exists, remove it before restoring", oldDir)
+		}
+		log.Printf("Moving existing data-dir %s to %s\n", dataDir, oldDir)
+		if err = fs.Rename(dataDir, oldDir); err != nil {
+			fs.RemoveAll(tmpDir)
+			return fmt.Errorf("could not rename %s to %s (%v)", dataDir, oldDir, err)
+		}
+		movedOld = true
+	}
+	if err = fs.Rename(tmpDir, dataDir); err != nil {
+		err = fmt.Errorf("could not rename %s to %s (%v)", tmpDir, dataDir, err)
+		if movedOld {
+			if rerr := fs.Rename(oldDir, dataDir); rerr != nil {
+				return fmt.Errorf("%v, and could not move %s back (%v)", err, oldDir, rerr)
+			}
+		}
+		fs.RemoveAll(tmpDir)
+		return err
+	}
+	log.Println("restored snapshot", dbPath, "to data-dir", dataDir)
 	return nil
 }
 
-func EtcdMemberAdd(ctx context.Context, cfg clientv3.Config, newMemberName string, peerURLs []string) error {
+func EtcdMemberAdd(ctx context.Context, o *Options, cfg clientv3.Config, newMemberName string, peerURLs []string) error {
+	if o.planned(ActionEtcdAPI, "MemberAdd", fmt.Sprintf("member %s with peer URLs %v via %v", newMemberName, peerURLs, cfg.Endpoints)) {
+		return nil
+	}
 	cli, err := clientv3.New(cfg)
 	if err != nil {
 		return err
@@ -91,7 +326,10 @@ func EtcdMemberAdd(ctx context.Context, cfg clientv3.Config, newMemberName strin
 	return nil
 }
 
-func EtcdMemberRemove(ctx context.Context, cfg clientv3.Config, memberName string) error {
+func EtcdMemberRemove(ctx context.Context, o *Options, cfg clientv3.Config, memberName string) error {
+	if o.planned(ActionEtcdAPI, "MemberRemove", fmt.Sprintf("member %s via %v", memberName, cfg.Endpoints)) {
+		return nil
+	}
 	cli, err := clientv3.New(cfg)
 	if err != nil {
 		return err
@@ -0,0 +1,194 @@
+package etcdutils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/etcd/embed"
+)
+
+// EtcdConf is the content of /etc/etcd/etcd.conf, the environment file etcd
+// is started with.
+type EtcdConf struct {
+	Name                     string
+	DataDir                  string
+	InitialCluster           string
+	InitialClusterToken      string
+	InitialClusterState      string
+	InitialAdvertisePeerURLs []string
+	AdvertiseClientURLs      []string
+	ListenPeerURLs           []string
+	ListenClientURLs         []string
+
+	CertFile           string
+	KeyFile            string
+	TrustedCAFile      string
+	ClientCertAuth     bool
+	PeerCertFile       string
+	PeerKeyFile        string
+	PeerTrustedCAFile  string
+	PeerClientCertAuth bool
+
+	// Env holds every variable of the file, including the ones not mapped
+	// to a field above.
+	Env map[string]string
+}
+
+// ParseEtcdConf parses the KEY=VALUE lines of an environment file. Blank
+// lines and lines starting with # are skipped, values may be quoted.
+func ParseEtcdConf(r io.Reader) (*EtcdConf, error) {
+	c := &EtcdConf{Env: map[string]string{}}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE, got %q", n, line)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		c.Env[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	c.Name = c.Env["ETCD_NAME"]
+	c.DataDir = c.Env["ETCD_DATA_DIR"]
+	c.InitialCluster = c.Env["ETCD_INITIAL_CLUSTER"]
+	c.InitialClusterToken = c.Env["ETCD_INITIAL_CLUSTER_TOKEN"]
+	c.InitialClusterState = c.Env["ETCD_INITIAL_CLUSTER_STATE"]
+	c.InitialAdvertisePeerURLs = splitList(c.Env["ETCD_INITIAL_ADVERTISE_PEER_URLS"])
+	c.AdvertiseClientURLs = splitList(c.Env["ETCD_ADVERTISE_CLIENT_URLS"])
+	c.ListenPeerURLs = splitList(c.Env["ETCD_LISTEN_PEER_URLS"])
+	c.ListenClientURLs = splitList(c.Env["ETCD_LISTEN_CLIENT_URLS"])
+	c.CertFile = c.Env["ETCD_CERT_FILE"]
+	c.KeyFile = c.Env["ETCD_KEY_FILE"]
+	c.TrustedCAFile = c.Env["ETCD_TRUSTED_CA_FILE"]
+	c.PeerCertFile = c.Env["ETCD_PEER_CERT_FILE"]
+	c.PeerKeyFile = c.Env["ETCD_PEER_KEY_FILE"]
+	c.PeerTrustedCAFile = c.Env["ETCD_PEER_TRUSTED_CA_FILE"]
+
+	var err error
+	if c.ClientCertAuth, err = parseBool(c.Env, "ETCD_CLIENT_CERT_AUTH"); err != nil {
+		return nil, err
+	}
+	if c.PeerClientCertAuth, err = parseBool(c.Env, "ETCD_PEER_CLIENT_CERT_AUTH"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadEtcdConf reads and parses the node's etcd.conf.
+func LoadEtcdConf(o *Options) (*EtcdConf, error) {
+	data, err := readFile(o.fs(), o.EtcdConf())
+	if err != nil {
+		return nil, err
+	}
+	c, err := ParseEtcdConf(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s (%v)", o.EtcdConf(), err)
+	}
+	return c, nil
+}
+
+// ApplyTo sets every field of cfg that is configured in the file. The
+// data-dir is a path on the node: it becomes o.EtcdDataDir, so the
+// workflows use the same one, and cfg.Dir is resolved below o.Root.
+// Replacing a different o.EtcdDataDir is logged.
+func (c *EtcdConf) ApplyTo(o *Options, cfg *embed.Config) error {
+	setString := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	setString(&cfg.Name, c.Name)
+	if c.DataDir != "" {
+		if c.DataDir != o.EtcdDataDir {
+			log.Printf("Using etcd data-dir %s from %s instead of %s\n", c.DataDir, o.EtcdConf(), o.EtcdDataDir)
+		}
+		o.EtcdDataDir = c.DataDir
+		cfg.Dir = o.DataDir()
+	}
+	setString(&cfg.InitialCluster, c.InitialCluster)
+	setString(&cfg.InitialClusterToken, c.InitialClusterToken)
+	setString(&cfg.ClusterState, c.InitialClusterState)
+
+	urls := []struct {
+		dst *[]url.URL
+		v   []string
+	}{
+		{&cfg.APUrls, c.InitialAdvertisePeerURLs},
+		{&cfg.ACUrls, c.AdvertiseClientURLs},
+		{&cfg.LPUrls, c.ListenPeerURLs},
+		{&cfg.LCUrls, c.ListenClientURLs},
+	}
+	for _, u := range urls {
+		if len(u.v) == 0 {
+			continue
+		}
+		parsed, err := parseURLs(u.v)
+		if err != nil {
+			return err
+		}
+		*u.dst = parsed
+	}
+
+	setString(&cfg.ClientTLSInfo.CertFile, c.CertFile)
+	setString(&cfg.ClientTLSInfo.KeyFile, c.KeyFile)
+	setString(&cfg.ClientTLSInfo.TrustedCAFile, c.TrustedCAFile)
+	cfg.ClientTLSInfo.ClientCertAuth = cfg.ClientTLSInfo.ClientCertAuth || c.ClientCertAuth
+	cfg.ClientAutoTLS = cfg.ClientAutoTLS && c.CertFile == ""
+	setString(&cfg.PeerTLSInfo.CertFile, c.PeerCertFile)
+	setString(&cfg.PeerTLSInfo.KeyFile, c.PeerKeyFile)
+	setString(&cfg.PeerTLSInfo.TrustedCAFile, c.PeerTrustedCAFile)
+	cfg.PeerTLSInfo.ClientCertAuth = cfg.PeerTLSInfo.ClientCertAuth || c.PeerClientCertAuth
+	cfg.PeerAutoTLS = cfg.PeerAutoTLS && c.PeerCertFile == ""
+	return nil
+}
+
+func splitList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func parseURLs(list []string) ([]url.URL, error) {
+	urls := make([]url.URL, 0, len(list))
+	for _, s := range list {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, *u)
+	}
+	return urls, nil
+}
+
+func parseBool(env map[string]string, key string) (bool, error) {
+	v, ok := env[key]
+	if !ok || v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", key, err)
+	}
+	return b, nil
+}
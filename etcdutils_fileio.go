@@ -5,31 +5,34 @@ package etcdutils
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
 )
 
-func fileExists(filename string) bool {
-	info, err := os.Stat(filename)
-	if os.IsNotExist(err) {
+func fileExists(fs FS, filename string) bool {
+	info, err := fs.Stat(filename)
+	if err != nil {
 		return false
 	}
 	return !info.IsDir()
 }
 
-func copyFile(src, dst string) error {
+func copyFile(o *Options, src, dst string) error {
+	if o.planned(ActionCopy, src, "to "+dst) {
+		return nil
+	}
+	fs := o.fs()
 	var err error
-	var srcfd *os.File
-	var dstfd *os.File
+	var srcfd File
+	var dstfd File
 	var srcinfo os.FileInfo
 
-	if srcfd, err = os.Open(src); err != nil {
+	if srcfd, err = fs.Open(src); err != nil {
 		return err
 	}
 	defer srcfd.Close()
 
-	if dstfd, err = os.Create(dst); err != nil {
+	if dstfd, err = fs.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666); err != nil {
 		return err
 	}
 	defer dstfd.Close()
@@ -37,27 +40,31 @@ func copyFile(src, dst string) error {
 	if _, err = io.Copy(dstfd, srcfd); err != nil {
 		return err
 	}
-	if srcinfo, err = os.Stat(src); err != nil {
+	if srcinfo, err = fs.Stat(src); err != nil {
 		return err
 	}
-	return os.Chmod(dst, srcinfo.Mode())
+	return fs.Chmod(dst, srcinfo.Mode())
 }
 
 // copyDir copies a whole directory recursively
-func copyDir(src string, dst string) error {
+func copyDir(o *Options, src string, dst string) error {
+	if o.planned(ActionCopy, src, "recursively to "+dst) {
+		return nil
+	}
+	fs := o.fs()
 	var err error
 	var fds []os.FileInfo
 	var srcinfo os.FileInfo
 
-	if srcinfo, err = os.Stat(src); err != nil {
+	if srcinfo, err = fs.Stat(src); err != nil {
 		return err
 	}
 
-	if err = os.MkdirAll(dst, srcinfo.Mode()); err != nil {
+	if err = fs.MkdirAll(dst, srcinfo.Mode()); err != nil {
 		return err
 	}
 
-	if fds, err = ioutil.ReadDir(src); err != nil {
+	if fds, err = fs.ReadDir(src); err != nil {
 		return err
 	}
 	for _, fd := range fds {
@@ -65,23 +72,39 @@ func copyDir(src string, dst string) error {
 		dstfp := path.Join(dst, fd.Name())
 
 		if fd.IsDir() {
-			if err = copyDir(srcfp, dstfp); err != nil {
-				fmt.Println(err)
-			}
+			err = copyDir(o, srcfp, dstfp)
 		} else {
-			if err = copyFile(srcfp, dstfp); err != nil {
-				fmt.Println(err)
-			}
+			err = copyFile(o, srcfp, dstfp)
+		}
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func checkAndCreateDir(dirName string) bool {
-	src, err := os.Stat(dirName)
+func moveFile(o *Options, src, dst string) error {
+	if o.planned(ActionMove, src, "to "+dst) {
+		return nil
+	}
+	return o.fs().Rename(src, dst)
+}
+
+func removeAll(o *Options, path string) error {
+	if o.planned(ActionDelete, path, "") {
+		return nil
+	}
+	return o.fs().RemoveAll(path)
+}
+
+func checkAndCreateDir(o *Options, dirName string) bool {
+	src, err := o.fs().Stat(dirName)
 
 	if os.IsNotExist(err) {
-		errDir := os.MkdirAll(dirName, os.ModePerm)
+		if o.planned(ActionMkdir, dirName, "") {
+			return true
+		}
+		errDir := o.fs().MkdirAll(dirName, os.ModePerm)
 		if errDir != nil {
 			panic(err)
 		}
@@ -95,3 +118,27 @@ func checkAndCreateDir(dirName string) bool {
 
 	return false
 }
+
+// writeFileAtomic writes data to a temporary file next to filename and
+// renames it into place, so readers never observe a partially written file.
+func writeFileAtomic(fs FS, filename string, data []byte, perm os.FileMode) error {
+	tmp := filename + ".tmp"
+	f, err := fs.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fs.Chmod(tmp, perm)
+	}
+	if err != nil {
+		fs.Remove(tmp)
+		return err
+	}
+	return fs.Rename(tmp, filename)
+}
@@ -0,0 +1,58 @@
+package etcdutils
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// File is an open file of an FS.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+	Sync() error
+}
+
+// FS is the filesystem the library works on. All node file operations go
+// through it, so whole recovery workflows can run against MemFS in tests.
+// Combined with Options.Root, OSFS gives a chroot-style view of a copy of a
+// master's filesystem.
+type FS interface {
+	Stat(name string) (os.FileInfo, error)
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	Glob(pattern string) ([]string, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	Chmod(name string, mode os.FileMode) error
+}
+
+// OSFS is the FS of the host operating system.
+type OSFS struct{}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+func (OSFS) Open(name string) (File, error)        { return os.Open(name) }
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+func (OSFS) ReadDir(dirname string) ([]os.FileInfo, error) { return ioutil.ReadDir(dirname) }
+func (OSFS) Glob(pattern string) ([]string, error)         { return filepath.Glob(pattern) }
+func (OSFS) MkdirAll(path string, perm os.FileMode) error  { return os.MkdirAll(path, perm) }
+func (OSFS) Rename(oldpath, newpath string) error          { return os.Rename(oldpath, newpath) }
+func (OSFS) Remove(name string) error                      { return os.Remove(name) }
+func (OSFS) RemoveAll(path string) error                   { return os.RemoveAll(path) }
+func (OSFS) Chmod(name string, mode os.FileMode) error     { return os.Chmod(name, mode) }
+
+func readFile(fs FS, filename string) ([]byte, error) {
+	f, err := fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,129 @@
+package etcdutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Journal outcomes recorded for a step.
+const (
+	OutcomeStarted    = "started"
+	OutcomeDone       = "done"
+	OutcomeFailed     = "failed"
+	OutcomeRolledBack = "rolled-back"
+)
+
+type JournalEntry struct {
+	Step    string            `json:"step"`
+	Time    time.Time         `json:"time"`
+	Inputs  map[string]string `json:"inputs,omitempty"`
+	Outcome string            `json:"outcome"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// Journal persists the progress of a workflow in the asset dir so that a
+// run that got killed partway through can be resumed without repeating the
+// steps that already completed.
+type Journal struct {
+	fs       FS
+	path     string
+	dryRun   bool
+	Workflow string         `json:"workflow"`
+	Entries  []JournalEntry `json:"entries"`
+}
+
+// OpenJournal loads the journal of the named workflow from the asset dir,
+// or starts an empty one if none exists yet.
+// In dry-run mode the journal is only kept in memory.
+func OpenJournal(o *Options, workflow string) (*Journal, error) {
+	if !o.DryRun() {
+		if err := o.fs().MkdirAll(o.AssetPath(), os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	j := &Journal{
+		fs:       o.fs(),
+		path:     o.AssetPath("journal-" + workflow + ".json"),
+		dryRun:   o.DryRun(),
+		Workflow: workflow,
+	}
+	data, err := readFile(j.fs, j.path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("could not parse journal %s (%v)", j.path, err)
+	}
+	return j, nil
+}
+
+func (j *Journal) Path() string {
+	return j.path
+}
+
+// last returns the most recent entry recorded for step.
+func (j *Journal) last(step string) (JournalEntry, bool) {
+	for i := len(j.Entries) - 1; i >= 0; i-- {
+		if j.Entries[i].Step == step {
+			return j.Entries[i], true
+		}
+	}
+	return JournalEntry{}, false
+}
+
+// Completed reports whether step has finished successfully and was not
+// rolled back since.
+func (j *Journal) Completed(step string) bool {
+	e, ok := j.last(step)
+	return ok && e.Outcome == OutcomeDone
+}
+
+// CheckInputs verifies that a step is resumed with the inputs it was
+// originally recorded with.
+func (j *Journal) CheckInputs(step string, inputs map[string]string) error {
+	e, ok := j.last(step)
+	if !ok {
+		return nil
+	}
+	for k, v := range inputs {
+		if recorded, ok := e.Inputs[k]; ok && recorded != v {
+			return fmt.Errorf("step %q was recorded with %s=%q, not %q; remove %s to start over", step, k, recorded, v, j.path)
+		}
+	}
+	return nil
+}
+
+func (j *Journal) Record(step string, inputs map[string]string, outcome string, stepErr error) error {
+	e := JournalEntry{
+		Step:    step,
+		Time:    time.Now().UTC(),
+		Inputs:  inputs,
+		Outcome: outcome,
+	}
+	if stepErr != nil {
+		e.Error = stepErr.Error()
+	}
+	j.Entries = append(j.Entries, e)
+	if j.dryRun {
+		return nil
+	}
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.fs, j.path, data, 0600)
+}
+
+// Finish archives the journal of a completed workflow, so that the next run
+// starts from the beginning.
+func (j *Journal) Finish() error {
+	if j.dryRun {
+		return nil
+	}
+	return j.fs.Rename(j.path, j.path+".done")
+}
@@ -0,0 +1,96 @@
+package etcdutils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+const kubeconfigTemplate = `
+clusters:
+- cluster:
+    certificate-authority-data: {{.CA}}
+    server: https://{{.RECOVERY_SERVER_IP}}:9943
+  name: {{.CLUSTER_NAME}}
+contexts:
+- context:
+    cluster: {{.CLUSTER_NAME}}
+    user: kubelet
+  name: kubelet
+current-context: kubelet
+preferences: {}
+users:
+- name: kubelet
+  user:
+    client-certificate-data: {{.CERT}}
+    client-key-data: {{.KEY}}
+`
+
+// KubeconfigParams describe the kubeconfig kube-client-agent uses to
+// request certs from the signer on the recovery server.
+type KubeconfigParams struct {
+	RecoveryServerIP string
+	ClusterName      string
+	// CA, Cert and Key are PEM data. Empty ones are read from the etcd
+	// client certs in the backup dir.
+	CA   []byte
+	Cert []byte
+	Key  []byte
+}
+
+// Kubeconfig renders the kubeconfig for p.
+func (p KubeconfigParams) Kubeconfig(o *Options) ([]byte, error) {
+	if p.RecoveryServerIP == "" || p.ClusterName == "" {
+		return nil, fmt.Errorf("recovery server IP and cluster name must be set")
+	}
+	files := []struct {
+		data *[]byte
+		name string
+	}{
+		{&p.CA, "etcd-ca-bundle.crt"},
+		{&p.Cert, "etcd-client.crt"},
+		{&p.Key, "etcd-client.key"},
+	}
+	for _, f := range files {
+		if len(*f.data) != 0 {
+			continue
+		}
+		data, err := readFile(o.fs(), o.BackupPath(f.name))
+		if err != nil {
+			return nil, fmt.Errorf("could not read backed up etcd client cert (%v)", err)
+		}
+		*f.data = data
+	}
+
+	var buf bytes.Buffer
+	t := template.Must(template.New("kubeconfig").Parse(kubeconfigTemplate))
+	err := t.Execute(&buf, map[string]string{
+		"CA":                 base64.StdEncoding.EncodeToString(p.CA),
+		"CERT":               base64.StdEncoding.EncodeToString(p.Cert),
+		"KEY":                base64.StdEncoding.EncodeToString(p.Key),
+		"RECOVERY_SERVER_IP": p.RecoveryServerIP,
+		"CLUSTER_NAME":       p.ClusterName,
+	})
+	return buf.Bytes(), err
+}
+
+// WriteKubeconfig writes the kubeconfig for p to path, a resolved path such
+// as o.AssetPath("shared", "kubeconfig"), readable only by its owner.
+func WriteKubeconfig(o *Options, p KubeconfigParams, path string) error {
+	data, err := p.Kubeconfig(o)
+	if err != nil {
+		return err
+	}
+	if o.planned(ActionWrite, path, "kubeconfig for cluster "+p.ClusterName) {
+		return nil
+	}
+	if err = o.fs().MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	log.Printf("Writing kubeconfig to %s..\n", path)
+	return writeFileAtomic(o.fs(), path, data, 0600)
+}
@@ -0,0 +1,45 @@
+package etcdutils
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestWriteKubeconfig(t *testing.T) {
+	o := newTestMaster(t)
+	if err := Init(o); err != nil {
+		t.Fatal(err)
+	}
+	if err := BackupEtcdClientCerts(o); err != nil {
+		t.Fatal(err)
+	}
+	path := o.AssetPath("shared", "kubeconfig")
+	params := KubeconfigParams{RecoveryServerIP: "10.0.128.73", ClusterName: "test"}
+	if err := WriteKubeconfig(o, params, path); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := o.fs().Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("kubeconfig mode = %v, want 0600", info.Mode().Perm())
+	}
+	ca, _ := readFile(o.fs(), o.BackupPath("etcd-ca-bundle.crt"))
+	data, _ := readFile(o.fs(), path)
+	for _, want := range []string{
+		"certificate-authority-data: " + base64.StdEncoding.EncodeToString(ca),
+		"server: https://10.0.128.73:9943",
+		"name: test",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("kubeconfig does not contain %q:\n%s", want, data)
+		}
+	}
+
+	if err = WriteKubeconfig(o, KubeconfigParams{ClusterName: "test"}, path); err == nil {
+		t.Error("expected an error without recovery server IP")
+	}
+}
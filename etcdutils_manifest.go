@@ -0,0 +1,280 @@
+package etcdutils
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Manifest is a static pod manifest loaded for editing. Edits are made on
+// the parsed pod and written back by Save.
+type Manifest struct {
+	o     *Options
+	path  string
+	mode  os.FileMode
+	pod   map[string]interface{}
+	edits []string
+}
+
+// LoadManifest parses the static pod manifest at path, a resolved path such
+// as o.EtcdManifest().
+func LoadManifest(o *Options, path string) (*Manifest, error) {
+	info, err := o.fs().Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readFile(o.fs(), path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{o: o, path: path, mode: info.Mode().Perm()}
+	if err = yaml.Unmarshal(data, &m.pod); err != nil {
+		return nil, fmt.Errorf("could not parse manifest %s (%v)", path, err)
+	}
+	if m.pod == nil {
+		return nil, fmt.Errorf("manifest %s is empty", path)
+	}
+	return m, nil
+}
+
+// Save writes the manifest back atomically, keeping its file mode.
+func (m *Manifest) Save() error {
+	if m.o.planned(ActionPatch, m.path, strings.Join(m.edits, ", ")) {
+		return nil
+	}
+	data, err := yaml.Marshal(m.pod)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.o.fs(), m.path, data, m.mode)
+}
+
+// SetImage sets the image of the named container.
+func (m *Manifest) SetImage(container, image string) error {
+	c, err := m.container(container)
+	if err != nil {
+		return err
+	}
+	c["image"] = image
+	m.edits = append(m.edits, fmt.Sprintf("%s image %s", container, image))
+	return nil
+}
+
+// SetFlag adds or replaces a command line flag of the named container. An
+// empty value sets a flag without argument, such as --force-new-cluster.
+// Flags are looked up in args and command and, for containers started by a
+// shell script like etcd, in the script's exec line. A flag given as two
+// list elements, like ["--data-dir", "/var/lib/etcd"], keeps that form; the
+// element after a flag in etcdBoolFlags is never taken for its argument.
+func (m *Manifest) SetFlag(container, flag, value string) error {
+	c, err := m.container(container)
+	if err != nil {
+		return err
+	}
+	flag = "--" + strings.TrimLeft(flag, "-")
+	arg := flag
+	if value != "" {
+		arg += "=" + value
+	}
+	m.edits = append(m.edits, fmt.Sprintf("%s flag %s", container, arg))
+
+	for _, field := range []string{"args", "command"} {
+		list := stringList(c[field])
+		for i, s := range list {
+			switch {
+			case s == flag && separateFlagArg(list, i):
+				if value == "" {
+					list = append(list[:i+1], list[i+2:]...)
+				} else {
+					list[i+1] = value
+				}
+			case s == flag || strings.HasPrefix(s, flag+"="):
+				list[i] = arg
+			default:
+				continue
+			}
+			c[field] = list
+			return nil
+		}
+	}
+	if i, script := execScript(c); script != "" {
+		command := stringList(c["command"])
+		re := flagPattern(flag)
+		if re.MatchString(script) {
+			command[i] = re.ReplaceAllString(script, "${1}"+strings.Replace(shellArg(arg), "$", "$$", -1)+"${4}")
+		} else {
+			exec := execLine.FindStringIndex(script)
+			command[i] = script[:exec[1]] + " " + shellArg(arg) + script[exec[1]:]
+		}
+		c["command"] = command
+		return nil
+	}
+	field := "args"
+	if _, ok := c["args"]; !ok {
+		field = "command"
+	}
+	c[field] = append(stringList(c[field]), arg)
+	return nil
+}
+
+// RemoveFlag removes a command line flag set with SetFlag.
+func (m *Manifest) RemoveFlag(container, flag string) error {
+	c, err := m.container(container)
+	if err != nil {
+		return err
+	}
+	flag = "--" + strings.TrimLeft(flag, "-")
+	m.edits = append(m.edits, fmt.Sprintf("%s remove flag %s", container, flag))
+
+	for _, field := range []string{"args", "command"} {
+		list := stringList(c[field])
+		kept := []string{}
+		for i := 0; i < len(list); i++ {
+			switch s := list[i]; {
+			case s == flag && separateFlagArg(list, i):
+				i++
+			case s != flag && !strings.HasPrefix(s, flag+"="):
+				kept = append(kept, s)
+			}
+		}
+		if _, ok := c[field]; ok {
+			c[field] = kept
+		}
+	}
+	if i, script := execScript(c); script != "" {
+		command := stringList(c["command"])
+		script = flagLinePattern(flag).ReplaceAllLiteralString(script, "")
+		command[i] = flagPattern(flag).ReplaceAllString(script, "${4}")
+		c["command"] = command
+	}
+	return nil
+}
+
+// SetEnv sets an environment variable of the named container, replacing a
+// value or valueFrom it had before.
+func (m *Manifest) SetEnv(container, name, value string) error {
+	c, err := m.container(container)
+	if err != nil {
+		return err
+	}
+	m.edits = append(m.edits, fmt.Sprintf("%s env %s=%s", container, name, value))
+
+	env, _ := c["env"].([]interface{})
+	for _, e := range env {
+		if v, ok := e.(map[string]interface{}); ok && v["name"] == name {
+			delete(v, "valueFrom")
+			v["value"] = value
+			return nil
+		}
+	}
+	c["env"] = append(env, map[string]interface{}{"name": name, "value": value})
+	return nil
+}
+
+// SetHostPath points the named hostPath volume at path.
+func (m *Manifest) SetHostPath(volume, path string) error {
+	spec, _ := m.pod["spec"].(map[string]interface{})
+	volumes, _ := spec["volumes"].([]interface{})
+	for _, v := range volumes {
+		vol, ok := v.(map[string]interface{})
+		if !ok || vol["name"] != volume {
+			continue
+		}
+		hostPath, ok := vol["hostPath"].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("volume %q in %s is not a hostPath volume", volume, m.path)
+		}
+		hostPath["path"] = path
+		m.edits = append(m.edits, fmt.Sprintf("volume %s hostPath %s", volume, path))
+		return nil
+	}
+	return fmt.Errorf("volume %q not found in %s", volume, m.path)
+}
+
+func (m *Manifest) container(name string) (map[string]interface{}, error) {
+	spec, _ := m.pod["spec"].(map[string]interface{})
+	for _, field := range []string{"containers", "initContainers"} {
+		containers, _ := spec[field].([]interface{})
+		for _, c := range containers {
+			if c, ok := c.(map[string]interface{}); ok && c["name"] == name {
+				return c, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("container %q not found in %s", name, m.path)
+}
+
+// execLine matches the line of a container's shell script that starts the
+// actual binary, e.g. exec etcd.
+var execLine = regexp.MustCompile(`(?m)^\s*exec\s+\S+`)
+
+// execScript returns the index and content of the shell script in the
+// container's command, if it has one.
+func execScript(c map[string]interface{}) (int, string) {
+	for i, s := range stringList(c["command"]) {
+		if execLine.MatchString(s) {
+			return i, s
+		}
+	}
+	return -1, ""
+}
+
+const flagArgPattern = `(=("[^"]*"|'[^']*'|[^\s\\]*))?`
+
+// flagPattern matches flag with its argument, if any, in a shell script.
+func flagPattern(flag string) *regexp.Regexp {
+	return regexp.MustCompile(`([ \t]+)` + regexp.QuoteMeta(flag) + flagArgPattern + `(\s|$)`)
+}
+
+// flagLinePattern matches a continuation line holding only flag.
+func flagLinePattern(flag string) *regexp.Regexp {
+	return regexp.MustCompile(`(?m)^[ \t]*` + regexp.QuoteMeta(flag) + flagArgPattern + `[ \t]*\\\n`)
+}
+
+// etcdBoolFlags are the flags of etcd, its gateway and grpc-proxy that take
+// no argument, so the element following them is never their value.
+var etcdBoolFlags = map[string]bool{
+	"--auto-tls":                           true,
+	"--client-cert-auth":                   true,
+	"--debug":                              true,
+	"--enable-grpc-gateway":                true,
+	"--enable-pprof":                       true,
+	"--enable-v2":                          true,
+	"--experimental-initial-corrupt-check": true,
+	"--force-new-cluster":                  true,
+	"--insecure-discovery":                 true,
+	"--insecure-skip-tls-verify":           true,
+	"--insecure-transport":                 true,
+	"--peer-auto-tls":                      true,
+	"--peer-client-cert-auth":              true,
+	"--strict-reconfig-check":              true,
+}
+
+// separateFlagArg reports whether the flag at list[i] takes the following
+// element as its argument: it must take an argument and the element must
+// not be a flag itself.
+func separateFlagArg(list []string, i int) bool {
+	return !etcdBoolFlags[list[i]] && i+1 < len(list) && !strings.HasPrefix(list[i+1], "-")
+}
+
+func shellArg(arg string) string {
+	if strings.ContainsAny(arg, " \t\n'\"") {
+		return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+	}
+	return arg
+}
+
+func stringList(v interface{}) []string {
+	if s, ok := v.([]string); ok {
+		return s
+	}
+	list, _ := v.([]interface{})
+	s := make([]string, 0, len(list))
+	for _, e := range list {
+		s = append(s, fmt.Sprint(e))
+	}
+	return s
+}
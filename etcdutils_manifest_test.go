@@ -0,0 +1,201 @@
+package etcdutils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testEtcdManifest = `apiVersion: v1
+kind: Pod
+metadata:
+  name: etcd-member
+  namespace: openshift-etcd
+spec:
+  containers:
+  - name: etcd-member
+    image: quay.io/openshift/etcd:v3.3.10
+    command:
+    - /bin/sh
+    - -c
+    - |
+      #!/bin/sh
+      set -euo pipefail
+      source /run/etcd/environment
+      exec etcd \
+        --initial-advertise-peer-urls=https://${ETCD_IPV4_ADDRESS}:2380 \
+        --initial-cluster-state=new \
+        --cert-file=/etc/ssl/etcd/system:etcd-server:${ETCD_DNS_NAME}.crt
+    env:
+    - name: ETCD_DATA_DIR
+      value: /var/lib/etcd
+    - name: ETCD_NAME
+      valueFrom:
+        fieldRef:
+          fieldPath: metadata.name
+  - name: etcd-metrics
+    image: quay.io/openshift/etcd:v3.3.10
+    args:
+    - grpc-proxy
+    - --listen-addr=https://0.0.0.0:9979
+    - --data-dir
+    - /var/lib/etcd
+    - --cacert
+    - /etc/ssl/etcd/ca.crt
+  volumes:
+  - name: data-dir
+    hostPath:
+      path: /var/lib/etcd
+`
+
+func loadTestManifest(t *testing.T) (*Options, *Manifest) {
+	o := &Options{Paths: DefaultOptions().Paths, FS: NewMemFS()}
+	if err := o.FS.(*MemFS).WriteFile(o.EtcdManifest(), []byte(testEtcdManifest), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadManifest(o, o.EtcdManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o, m
+}
+
+func TestManifestEdit(t *testing.T) {
+	o, m := loadTestManifest(t)
+	edits := []error{
+		m.SetImage("etcd-member", "quay.io/openshift/etcd:v3.3.17"),
+		m.SetFlag("etcd-member", "initial-cluster-state", "existing"),
+		m.SetFlag("etcd-member", "--force-new-cluster", ""),
+		m.SetFlag("etcd-metrics", "--listen-addr", "https://0.0.0.0:9980"),
+		m.SetFlag("etcd-metrics", "--key", "/etc/ssl/etcd/metric.key"),
+		m.SetFlag("etcd-metrics", "--data-dir", "/var/lib/etcd-restored"),
+		m.SetEnv("etcd-member", "ETCD_NAME", "etcd-member-master-0"),
+		m.SetEnv("etcd-member", "ETCD_QUOTA_BACKEND_BYTES", "7516192768"),
+		m.SetHostPath("data-dir", "/var/lib/etcd-restored"),
+	}
+	for _, err := range edits {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := o.fs().Stat(o.EtcdManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("manifest mode = %v, want 0600", info.Mode().Perm())
+	}
+	data, _ := readFile(o.fs(), o.EtcdManifest())
+	got := string(data)
+	for _, want := range []string{
+		"image: quay.io/openshift/etcd:v3.3.17",
+		"exec etcd --force-new-cluster \\\n",
+		"--initial-cluster-state=existing \\\n",
+		"--cert-file=/etc/ssl/etcd/system:etcd-server:${ETCD_DNS_NAME}.crt",
+		"- --listen-addr=https://0.0.0.0:9980",
+		"- --key=/etc/ssl/etcd/metric.key",
+		"- --data-dir\n    - /var/lib/etcd-restored\n",
+		"value: etcd-member-master-0",
+		"value: \"7516192768\"",
+		"path: /var/lib/etcd-restored",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("manifest does not contain %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "initial-cluster-state=new") || strings.Contains(got, "fieldPath") {
+		t.Errorf("old values left in manifest:\n%s", got)
+	}
+
+	m, err = LoadManifest(o, o.EtcdManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.RemoveFlag("etcd-member", "--force-new-cluster"); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.RemoveFlag("etcd-member", "--initial-cluster-state"); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.RemoveFlag("etcd-metrics", "--data-dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.SetFlag("etcd-metrics", "--cacert", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = readFile(o.fs(), o.EtcdManifest())
+	if got = string(data); strings.Contains(got, "force-new-cluster") || strings.Contains(got, "initial-cluster-state") {
+		t.Errorf("flags not removed:\n%s", got)
+	}
+	if !strings.Contains(got, "exec etcd \\\n") {
+		t.Errorf("exec line broken:\n%s", got)
+	}
+	if strings.Contains(got, "- --data-dir") || strings.Contains(got, "ca.crt") || !strings.Contains(got, "- --cacert\n") {
+		t.Errorf("separate flag arguments left in manifest:\n%s", got)
+	}
+}
+
+func TestManifestBoolFlag(t *testing.T) {
+	o := &Options{Paths: DefaultOptions().Paths, FS: NewMemFS()}
+	manifest := `apiVersion: v1
+kind: Pod
+spec:
+  containers:
+  - name: etcd-gateway
+    args:
+    - gateway
+    - --debug
+    - start
+    - --endpoints
+    - 10.0.0.1:2379
+`
+	if err := o.FS.(*MemFS).WriteFile(o.EtcdManifest(), []byte(manifest), 0600); err != nil {
+		t.Fatal(err)
+	}
+	args := func(m *Manifest) []string {
+		c, err := m.container("etcd-gateway")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stringList(c["args"])
+	}
+
+	m, err := LoadManifest(o, o.EtcdManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.SetFlag("etcd-gateway", "--debug", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.SetFlag("etcd-gateway", "--endpoints", "10.0.0.2:2379"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"gateway", "--debug", "start", "--endpoints", "10.0.0.2:2379"}
+	if got := args(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("args after SetFlag = %q, want %q", got, want)
+	}
+	if err = m.RemoveFlag("etcd-gateway", "--debug"); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"gateway", "start", "--endpoints", "10.0.0.2:2379"}
+	if got := args(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("args after RemoveFlag = %q, want %q", got, want)
+	}
+}
+
+func TestManifestEditErrors(t *testing.T) {
+	_, m := loadTestManifest(t)
+	if err := m.SetImage("kube-apiserver", "image"); err == nil {
+		t.Error("expected an error for an unknown container")
+	}
+	if err := m.SetHostPath("certs", "/etc/ssl"); err == nil {
+		t.Error("expected an error for an unknown volume")
+	}
+}
@@ -0,0 +1,265 @@
+package etcdutils
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is an in-memory FS for tests. Relative names are taken relative to
+// its root directory "/".
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+}
+
+type memNode struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{files: map[string]*memNode{
+		"/": {mode: os.ModeDir | 0755, modTime: time.Now()},
+	}}
+}
+
+func memPath(name string) string {
+	return filepath.Join("/", name)
+}
+
+func memErr(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// WriteFile creates name and its parent dirs with the given content.
+func (m *MemFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if err := m.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := m.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.files[memPath(name)]
+	if !ok {
+		return nil, memErr("stat", name, os.ErrNotExist)
+	}
+	return &memFileInfo{name: filepath.Base(memPath(name)), node: *n, size: len(n.data)}, nil
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := memPath(name)
+	n, ok := m.files[p]
+	switch {
+	case ok && n.mode.IsDir() && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, memErr("open", name, os.ErrInvalid)
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, memErr("open", name, os.ErrExist)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, memErr("open", name, os.ErrNotExist)
+	case !ok:
+		parent, ok := m.files[filepath.Dir(p)]
+		if !ok || !parent.mode.IsDir() {
+			return nil, memErr("open", name, os.ErrNotExist)
+		}
+		n = &memNode{mode: perm.Perm(), modTime: time.Now()}
+		m.files[p] = n
+	}
+	if flag&os.O_TRUNC != 0 {
+		n.data = nil
+	}
+	f := &memFile{fs: m, node: n, writable: flag&(os.O_WRONLY|os.O_RDWR) != 0}
+	if !f.writable {
+		f.r = bytes.NewReader(append([]byte(nil), n.data...))
+	}
+	return f, nil
+}
+
+func (m *MemFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir := memPath(dirname)
+	if n, ok := m.files[dir]; !ok || !n.mode.IsDir() {
+		return nil, memErr("readdir", dirname, os.ErrNotExist)
+	}
+	var infos []os.FileInfo
+	for p, n := range m.files {
+		if p != "/" && filepath.Dir(p) == dir {
+			infos = append(infos, &memFileInfo{name: filepath.Base(p), node: *n, size: len(n.data)})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (m *MemFS) Glob(pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pattern = memPath(pattern)
+	var matches []string
+	for p := range m.files {
+		if ok, _ := filepath.Match(pattern, p); ok {
+			matches = append(matches, p)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func (m *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := memPath(path)
+	var missing []string
+	for ; ; p = filepath.Dir(p) {
+		if n, ok := m.files[p]; ok {
+			if !n.mode.IsDir() {
+				return memErr("mkdir", p, os.ErrExist)
+			}
+			break
+		}
+		missing = append(missing, p)
+	}
+	for _, dir := range missing {
+		m.files[dir] = &memNode{mode: os.ModeDir | perm.Perm(), modTime: time.Now()}
+	}
+	return nil
+}
+
+// children returns the names below dir.
+func (m *MemFS) children(dir string) []string {
+	var names []string
+	for p := range m.files {
+		if strings.HasPrefix(p, dir+"/") {
+			names = append(names, p)
+		}
+	}
+	return names
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from, to := memPath(oldpath), memPath(newpath)
+	n, ok := m.files[from]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if parent, ok := m.files[filepath.Dir(to)]; !ok || !parent.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if dst, ok := m.files[to]; ok && dst.mode.IsDir() && len(m.children(to)) != 0 {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrExist}
+	}
+	for _, child := range m.children(from) {
+		m.files[to+strings.TrimPrefix(child, from)] = m.files[child]
+		delete(m.files, child)
+	}
+	delete(m.files, from)
+	m.files[to] = n
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := memPath(name)
+	if _, ok := m.files[p]; !ok {
+		return memErr("remove", name, os.ErrNotExist)
+	}
+	if len(m.children(p)) != 0 {
+		return memErr("remove", name, os.ErrExist)
+	}
+	delete(m.files, p)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := memPath(path)
+	if p == "/" {
+		return memErr("removeall", path, os.ErrInvalid)
+	}
+	for _, child := range m.children(p) {
+		delete(m.files, child)
+	}
+	delete(m.files, p)
+	return nil
+}
+
+func (m *MemFS) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.files[memPath(name)]
+	if !ok {
+		return memErr("chmod", name, os.ErrNotExist)
+	}
+	n.mode = n.mode&os.ModeType | mode.Perm()
+	return nil
+}
+
+type memFile struct {
+	fs       *MemFS
+	node     *memNode
+	r        *bytes.Reader
+	writable bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.r == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.r.Read(p)
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if !f.writable {
+		return 0, os.ErrInvalid
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.node.data = append(f.node.data, p...)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Sync() error  { return nil }
+func (f *memFile) Close() error { return nil }
+
+type memFileInfo struct {
+	name string
+	node memNode
+	size int
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return int64(fi.size) }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.node.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.node.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.node.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,158 @@
+package etcdutils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// etcdMemberNamePrefix is prepended to the hostname to name etcd members.
+const etcdMemberNamePrefix = "etcd-member-"
+
+var (
+	hostname = os.Hostname
+
+	manifestNameFlag = regexp.MustCompile(`--name[= ]"?([^\s"\\]+)`)
+	manifestNameEnv  = regexp.MustCompile(`name:\s*"?ETCD_NAME"?\s*\n\s*value:\s*"?([^\s"]+)`)
+)
+
+// NameSource is the member name found in one place on the node or in the
+// cluster. Name is empty if the source has none.
+type NameSource struct {
+	Source string
+	Name   string
+	Detail string
+}
+
+type EtcdNameReport struct {
+	// Canonical is the name etcd on this node runs with.
+	Canonical  string
+	Sources    []NameSource
+	Mismatches []string
+}
+
+// ValidateEtcdName gathers the member name from etcd.conf, the etcd
+// manifest, the hostname and, when cfg has endpoints, the cluster's member
+// list, and reports where they disagree. It returns an error if no name can
+// be found or the sources do not match.
+func ValidateEtcdName(ctx context.Context, o *Options, cfg clientv3.Config) (*EtcdNameReport, error) {
+	r := &EtcdNameReport{}
+
+	confName, confErr := etcdConfName(o)
+	r.addSource("etcd.conf", confName, confErr)
+	manifestName, manifestErr := etcdManifestName(o)
+	r.addSource(o.EtcdManifestName, manifestName, manifestErr)
+	host, hostErr := hostname()
+	if hostErr == nil {
+		host = etcdMemberNamePrefix + host
+	}
+	r.addSource("hostname", host, hostErr)
+
+	for _, name := range []string{confName, manifestName, host} {
+		if name != "" {
+			r.Canonical = name
+			break
+		}
+	}
+	if r.Canonical == "" {
+		return r, fmt.Errorf("no etcd member name found")
+	}
+
+	for _, s := range r.Sources {
+		if s.Name != "" && !sameMemberName(s.Name, r.Canonical) {
+			r.Mismatches = append(r.Mismatches, fmt.Sprintf("%s has %q, not %q", s.Source, s.Name, r.Canonical))
+		}
+	}
+
+	if len(cfg.Endpoints) != 0 {
+		names, err := memberNames(ctx, cfg)
+		switch {
+		case err != nil:
+			r.Sources = append(r.Sources, NameSource{Source: "member list", Detail: err.Error()})
+		case !containsMemberName(names, r.Canonical):
+			r.Sources = append(r.Sources, NameSource{Source: "member list", Detail: strings.Join(names, ", ")})
+			r.Mismatches = append(r.Mismatches, fmt.Sprintf("%q is not in the member list [%s]", r.Canonical, strings.Join(names, ", ")))
+		default:
+			r.Sources = append(r.Sources, NameSource{Source: "member list", Name: r.Canonical})
+		}
+	}
+
+	if len(r.Mismatches) != 0 {
+		return r, fmt.Errorf("etcd member name mismatch: %s", strings.Join(r.Mismatches, "; "))
+	}
+	return r, nil
+}
+
+func (r *EtcdNameReport) addSource(source, name string, err error) {
+	s := NameSource{Source: source, Name: name}
+	if err != nil {
+		s.Detail = err.Error()
+	}
+	r.Sources = append(r.Sources, s)
+}
+
+// sameMemberName compares names with and without the etcd-member- prefix.
+func sameMemberName(a, b string) bool {
+	return strings.TrimPrefix(a, etcdMemberNamePrefix) == strings.TrimPrefix(b, etcdMemberNamePrefix)
+}
+
+func containsMemberName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func etcdConfName(o *Options) (string, error) {
+	c, err := LoadEtcdConf(o)
+	if err != nil {
+		return "", err
+	}
+	return c.Name, nil
+}
+
+// etcdManifestName looks for the name in the --name flag or the ETCD_NAME
+// env var of the etcd manifest. Names that are shell variables are resolved
+// at runtime and are not reported.
+func etcdManifestName(o *Options) (string, error) {
+	manifest := o.EtcdManifest()
+	data, err := readFile(o.fs(), manifest)
+	if os.IsNotExist(err) {
+		manifest = o.StoppedEtcdManifest()
+		data, err = readFile(o.fs(), manifest)
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, re := range []*regexp.Regexp{manifestNameFlag, manifestNameEnv} {
+		if m := re.FindSubmatch(data); m != nil && !bytes.Contains(m[1], []byte("$")) {
+			return string(m[1]), nil
+		}
+	}
+	return "", nil
+}
+
+func memberNames(ctx context.Context, cfg clientv3.Config) ([]string, error) {
+	cli, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	resp, err := cli.MemberList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, m := range resp.Members {
+		names = append(names, m.Name)
+	}
+	return names, nil
+}
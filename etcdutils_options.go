@@ -0,0 +1,150 @@
+package etcdutils
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Paths holds the on-node locations the recovery utilities work with. Every
+// path, including AssetDir, is resolved below Root, which lets the library
+// run against a copy of a master's filesystem. So are the snapshot, snapshot
+// key and signer CA paths passed to the functions taking Options. The
+// options file and the files given to ClientTLSConfig are used as given.
+type Paths struct {
+	Root                  string `json:"root,omitempty"`
+	KubernetesDir         string `json:"kubernetesDir,omitempty"`
+	AssetDir              string `json:"assetDir,omitempty"`
+	ManifestDir           string `json:"manifestDir,omitempty"`
+	ManifestStoppedDir    string `json:"manifestStoppedDir,omitempty"`
+	EtcdManifestName      string `json:"etcdManifestName,omitempty"`
+	EtcdConfPath          string `json:"etcdConfPath,omitempty"`
+	EtcdDataDir           string `json:"etcdDataDir,omitempty"`
+	EtcdStaticResourceDir string `json:"etcdStaticResourceDir,omitempty"`
+}
+
+// Options is passed to every operation that touches the node.
+type Options struct {
+	Paths
+
+	// FS is the filesystem node files are accessed through, OSFS if nil.
+	FS FS `json:"-"`
+	// Services controls kubelet, SystemctlManager if nil.
+	Services ServiceManager `json:"-"`
+	// Runtime stops containers, CrictlRuntime if nil.
+	Runtime ContainerRuntime `json:"-"`
+	// Plan switches on dry-run mode when set. Every operation that changes
+	// files, services or cluster membership then records what it would do
+	// in Plan instead of doing it.
+	Plan *Plan `json:"-"`
+}
+
+// DefaultOptions returns the layout of an OpenShift 4 master.
+func DefaultOptions() *Options {
+	return &Options{
+		Paths: Paths{
+			KubernetesDir:         "/etc/kubernetes",
+			AssetDir:              "./assets",
+			ManifestDir:           "/etc/kubernetes/manifests",
+			EtcdManifestName:      "etcd-member.yaml",
+			EtcdConfPath:          "/etc/etcd/etcd.conf",
+			EtcdDataDir:           "/var/lib/etcd",
+			EtcdStaticResourceDir: "/etc/kubernetes/static-pod-resources/etcd-member",
+		},
+	}
+}
+
+// LoadOptionsFile overrides the fields of o that are set in the YAML or
+// JSON file at path. The file may set Root, so path is not resolved below
+// it but read as is through the FS of o.
+func LoadOptionsFile(path string, o *Options) error {
+	data, err := readFile(o.fs(), path)
+	if err != nil {
+		return err
+	}
+	if err = yaml.Unmarshal(data, o); err != nil {
+		return fmt.Errorf("could not parse %s (%v)", path, err)
+	}
+	return nil
+}
+
+func (o *Options) fs() FS {
+	if o.FS == nil {
+		return OSFS{}
+	}
+	return o.FS
+}
+
+func (o *Options) services() ServiceManager {
+	if o.Services == nil {
+		return SystemctlManager{}
+	}
+	return o.Services
+}
+
+func (o *Options) runtime() ContainerRuntime {
+	if o.Runtime == nil {
+		return CrictlRuntime{}
+	}
+	return o.Runtime
+}
+
+func (o *Options) resolve(p string) string {
+	if o.Root == "" {
+		return p
+	}
+	return filepath.Join(o.Root, p)
+}
+
+// KubernetesPath returns the resolved path of elem below the kubernetes dir.
+func (o *Options) KubernetesPath(elem ...string) string {
+	return o.resolve(filepath.Join(append([]string{o.KubernetesDir}, elem...)...))
+}
+
+// AssetPath returns the resolved path of elem below the asset dir.
+func (o *Options) AssetPath(elem ...string) string {
+	assetDir := o.AssetDir
+	if assetDir == "" {
+		assetDir = "."
+	}
+	return o.resolve(filepath.Join(append([]string{assetDir}, elem...)...))
+}
+
+// BackupPath returns the resolved path of elem below the backup dir.
+func (o *Options) BackupPath(elem ...string) string {
+	return o.AssetPath(append([]string{"backup"}, elem...)...)
+}
+
+func (o *Options) ManifestPath(elem ...string) string {
+	return o.resolve(filepath.Join(append([]string{o.ManifestDir}, elem...)...))
+}
+
+// ManifestStoppedPath returns the resolved path of elem below the dir that
+// holds stopped static pod manifests, assets/manifests-stopped by default.
+func (o *Options) ManifestStoppedPath(elem ...string) string {
+	if o.ManifestStoppedDir == "" {
+		return o.AssetPath(append([]string{"manifests-stopped"}, elem...)...)
+	}
+	return o.resolve(filepath.Join(append([]string{o.ManifestStoppedDir}, elem...)...))
+}
+
+func (o *Options) EtcdManifest() string {
+	return o.ManifestPath(o.EtcdManifestName)
+}
+
+func (o *Options) StoppedEtcdManifest() string {
+	return o.ManifestStoppedPath(o.EtcdManifestName)
+}
+
+func (o *Options) EtcdConf() string {
+	return o.resolve(o.EtcdConfPath)
+}
+
+func (o *Options) DataDir() string {
+	return o.resolve(o.EtcdDataDir)
+}
+
+func (o *Options) StaticResourcePath(elem ...string) string {
+	return o.resolve(filepath.Join(append([]string{o.EtcdStaticResourceDir}, elem...)...))
+}
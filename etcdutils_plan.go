@@ -0,0 +1,80 @@
+package etcdutils
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// Kinds of actions recorded in a dry-run Plan.
+const (
+	ActionMkdir         = "mkdir"
+	ActionCopy          = "copy"
+	ActionMove          = "move"
+	ActionDelete        = "delete"
+	ActionPatch         = "patch"
+	ActionWrite         = "write"
+	ActionStopService   = "stop-service"
+	ActionStartService  = "start-service"
+	ActionStopContainer = "stop-container"
+	ActionEtcdAPI       = "etcd-api"
+)
+
+// Action is a single change that an operation would make to the node or
+// the cluster.
+type Action struct {
+	Kind   string
+	Target string
+	Detail string
+}
+
+func (a Action) String() string {
+	if a.Detail == "" {
+		return fmt.Sprintf("%-13s %s", a.Kind, a.Target)
+	}
+	return fmt.Sprintf("%-13s %s (%s)", a.Kind, a.Target, a.Detail)
+}
+
+// Plan is the ordered list of actions collected during a dry run.
+type Plan struct {
+	mu      sync.Mutex
+	Actions []Action
+}
+
+func (p *Plan) add(a Action) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Actions = append(p.Actions, a)
+}
+
+// Print writes the plan as a numbered list to w.
+func (p *Plan) Print(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.Actions) == 0 {
+		fmt.Fprintln(w, "Dry run: no changes would be made.")
+		return
+	}
+	fmt.Fprintln(w, "Dry run: the following actions would be taken:")
+	for i, a := range p.Actions {
+		fmt.Fprintf(w, "%3d. %s\n", i+1, a)
+	}
+}
+
+// DryRun reports whether o only records its actions in o.Plan.
+func (o *Options) DryRun() bool {
+	return o != nil && o.Plan != nil
+}
+
+// planned records the action in o.Plan when running in dry-run mode and
+// reports whether the caller must skip carrying it out.
+func (o *Options) planned(kind, target, detail string) bool {
+	if !o.DryRun() {
+		return false
+	}
+	a := Action{Kind: kind, Target: target, Detail: detail}
+	log.Printf("[dry-run] %s\n", a)
+	o.Plan.add(a)
+	return true
+}
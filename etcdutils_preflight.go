@@ -0,0 +1,163 @@
+package etcdutils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// Outcomes of a preflight check.
+const (
+	CheckPass = "pass"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+)
+
+type CheckResult struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// PreflightReport is the list of checks run by ValidateEnvironment.
+type PreflightReport []CheckResult
+
+// Failed reports whether any check failed.
+func (r PreflightReport) Failed() bool {
+	for _, c := range r {
+		if c.Status == CheckFail {
+			return true
+		}
+	}
+	return false
+}
+
+func (r PreflightReport) Print(w io.Writer) {
+	for _, c := range r {
+		fmt.Fprintf(w, "[%s] %-26s %s\n", c.Status, c.Name, c.Message)
+	}
+}
+
+func (r *PreflightReport) add(name, status, format string, args ...interface{}) {
+	*r = append(*r, CheckResult{Name: name, Status: status, Message: fmt.Sprintf(format, args...)})
+}
+
+// ValidateEnvironment checks that the node is in a state a recovery can run
+// in: root privileges, the expected directories, enough disk space for the
+// backups, the tools used to control kubelet and containers, and the certs.
+func ValidateEnvironment(o *Options) PreflightReport {
+	var r PreflightReport
+
+	if uid := os.Geteuid(); uid == 0 {
+		r.add("root", CheckPass, "running as root")
+	} else {
+		r.add("root", CheckFail, "running as uid %d, recovery must run as root", uid)
+	}
+
+	dirs := []struct{ name, path string }{
+		{"manifest dir", o.ManifestPath()},
+		{"static-pod-resources", o.KubernetesPath("static-pod-resources")},
+		{"etcd data-dir", o.DataDir()},
+	}
+	for _, dir := range dirs {
+		if info, err := o.fs().Stat(dir.path); err != nil {
+			r.add(dir.name, CheckFail, "%v", err)
+		} else if !info.IsDir() {
+			r.add(dir.name, CheckFail, "%s is not a directory", dir.path)
+		} else {
+			r.add(dir.name, CheckPass, "%s", dir.path)
+		}
+	}
+
+	r.checkDiskSpace(o)
+
+	if _, ok := o.services().(SystemctlManager); ok {
+		r.checkTool("systemctl")
+	}
+	if _, ok := o.runtime().(CrictlRuntime); ok {
+		r.checkTool("crictl")
+	}
+
+	if etcdClientCertsBackedUp(o) {
+		r.add("etcd client certs", CheckPass, "backed up in %s", o.BackupPath())
+	} else if dir, ok := findEtcdClientCerts(o); ok {
+		r.add("etcd client certs", CheckPass, "found in %s", dir)
+	} else {
+		r.add("etcd client certs", CheckFail, "not found in %s or %s", o.BackupPath(), o.KubernetesPath("static-pod-resources"))
+	}
+	if report, err := ValidateEtcdName(context.Background(), o, clientv3.Config{}); err != nil {
+		r.add("etcd member name", CheckFail, "%v", err)
+	} else {
+		r.add("etcd member name", CheckPass, "%s", report.Canonical)
+	}
+	if certs, _ := o.fs().Glob(o.StaticResourcePath("system:etcd-*")); len(certs) != 0 {
+		r.add("etcd member certs", CheckPass, "%d files in %s", len(certs), o.StaticResourcePath())
+	} else {
+		r.add("etcd member certs", CheckWarn, "none found in %s, they have to be recovered", o.StaticResourcePath())
+	}
+	return r
+}
+
+func (r *PreflightReport) checkTool(name string) {
+	if path, err := exec.LookPath(name); err != nil {
+		r.add(name, CheckFail, "%s not found in PATH", name)
+	} else {
+		r.add(name, CheckPass, "%s", path)
+	}
+}
+
+// checkDiskSpace makes sure the asset dir can hold a copy of the data-dir
+// plus a snapshot, which is about as large as the db.
+func (r *PreflightReport) checkDiskSpace(o *Options) {
+	const name = "asset dir disk space"
+	if _, ok := o.fs().(OSFS); !ok {
+		r.add(name, CheckWarn, "free space cannot be determined for %T", o.fs())
+		return
+	}
+	dataDirSize := dirSize(o.fs(), o.DataDir())
+	dbSize := int64(0)
+	if info, err := o.fs().Stat(filepath.Join(o.DataDir(), "member", "snap", "db")); err == nil {
+		dbSize = info.Size()
+	}
+	needed := uint64(dataDirSize + dbSize)
+
+	// The asset dir may not exist yet, measure the closest existing parent.
+	path := o.AssetPath()
+	for {
+		if _, err := os.Stat(path); err == nil || filepath.Dir(path) == path {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+	free, err := diskFree(path)
+	switch {
+	case err != nil:
+		r.add(name, CheckWarn, "%v", err)
+	case free < needed:
+		r.add(name, CheckFail, "%s has %d MiB free, %d MiB needed", path, free>>20, needed>>20)
+	default:
+		r.add(name, CheckPass, "%s has %d MiB free, %d MiB needed", path, free>>20, needed>>20)
+	}
+}
+
+// dirSize returns the total size of the files below dir.
+func dirSize(fs FS, dir string) int64 {
+	fds, err := fs.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, fd := range fds {
+		if fd.IsDir() {
+			size += dirSize(fs, filepath.Join(dir, fd.Name()))
+		} else {
+			size += fd.Size()
+		}
+	}
+	return size
+}
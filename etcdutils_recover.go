@@ -0,0 +1,110 @@
+package etcdutils
+
+import (
+	"context"
+	"log"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+)
+
+// RecoverConfig describes the snapshot and the member that Recover restores
+// from it.
+type RecoverConfig struct {
+	SnapshotPath string
+
+	// Etcd carries the member name, initial cluster and cluster token used
+	// to bootstrap the restored member. Its Dir is taken from the options.
+	Etcd     embed.Config
+	PeerURLs []string
+
+	// Client reaches the restored member once it is started. Without an
+	// endpoint Recover does not wait for the member to become healthy.
+	Client clientv3.Config
+
+	// SkipHashCheck restores snapshots that fail VerifySnapshot.
+	SkipHashCheck bool
+	// SnapshotKey decrypts an encrypted snapshot.
+	SnapshotKey *SnapshotKey
+}
+
+// Recover runs the single node disaster recovery sequence of
+// openshift-recovery-tools.sh: back up the current state, stop etcd, wipe
+// its data-dir, restore the snapshot and start etcd again. It stops at the
+// first step that fails and unwinds the steps completed so far.
+// Progress is journaled in the asset dir and a rerun resumes an interrupted
+// recovery instead of starting over.
+func Recover(ctx context.Context, o *Options, rc RecoverConfig) error {
+	wf := RecoverWorkflow(o, rc)
+	j, err := OpenJournal(o, wf.Name)
+	if err != nil {
+		return err
+	}
+	wf.Journal = j
+	return wf.Run(ctx)
+}
+
+// RecoverWorkflow returns the steps run by Recover.
+func RecoverWorkflow(o *Options, rc RecoverConfig) *Workflow {
+	etcdCfg := rc.Etcd
+	etcdCfg.Dir = o.DataDir()
+	dataDirBackup := o.BackupPath("etcd")
+
+	return NewWorkflow("recover",
+		Step{
+			Name:   "verify snapshot",
+			Inputs: map[string]string{"snapshot": rc.SnapshotPath},
+			Do: func(ctx context.Context) error {
+				if rc.SkipHashCheck {
+					log.Printf("Snapshot verification of %s skipped..\n", rc.SnapshotPath)
+					return nil
+				}
+				return VerifySnapshot(o, rc.SnapshotPath, rc.SnapshotKey)
+			},
+		},
+		Step{
+			Name: "init asset dir",
+			Do:   func(ctx context.Context) error { return Init(o) },
+		},
+		Step{
+			Name: "back up etcd manifest",
+			Do:   func(ctx context.Context) error { return BackupManifest(o) },
+		},
+		Step{
+			Name: "back up etcd.conf",
+			Do:   func(ctx context.Context) error { return BackupEtcdConf(o) },
+		},
+		StopEtcdStep(o),
+		WaitForEtcdStoppedStep(o),
+		Step{
+			Name: "back up etcd data-dir",
+			Do:   func(ctx context.Context) error { return BackupDataDir(o) },
+		},
+		Step{
+			Name: "back up etcd certs",
+			Do:   func(ctx context.Context) error { return BackupCerts(o) },
+		},
+		Step{
+			Name:   "remove etcd data-dir",
+			Inputs: map[string]string{"data-dir": o.DataDir()},
+			Do:     func(ctx context.Context) error { return RemoveDataDir(o) },
+			Undo: func(ctx context.Context) error {
+				if !fileExists(o.fs(), dataDirBackup+"/member/snap/db") {
+					log.Printf("No data-dir backup in %s, %s is left empty\n", dataDirBackup, o.DataDir())
+					return nil
+				}
+				return copyDir(o, dataDirBackup, o.DataDir())
+			},
+		},
+		Step{
+			Name:   "restore snapshot",
+			Inputs: map[string]string{"snapshot": rc.SnapshotPath, "data-dir": o.DataDir(), "name": etcdCfg.Name},
+			Do: func(ctx context.Context) error {
+				return RestoreSnapshot(ctx, o, etcdCfg, rc.PeerURLs, rc.SnapshotPath, rc.SkipHashCheck, rc.SnapshotKey)
+			},
+			Undo: func(ctx context.Context) error { return RemoveDataDir(o) },
+		},
+		StartEtcdStep(o),
+		WaitForEtcdHealthyStep(o, rc.Client),
+	)
+}
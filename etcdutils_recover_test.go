@@ -0,0 +1,168 @@
+package etcdutils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+func newTestMaster(t *testing.T) *Options {
+	fs := NewMemFS()
+	files := map[string]string{
+		"/etc/kubernetes/manifests/etcd-member.yaml":        "etcd manifest",
+		"/etc/kubernetes/manifests/kube-apiserver-pod.yaml": "apiserver manifest",
+		"/etc/etcd/etcd.conf":                               "ETCD_NAME=etcd-member-master-0",
+		"/etc/kubernetes/static-pod-resources/kube-apiserver-pod-3/configmaps/etcd-serving-ca/ca-bundle.crt": "ca",
+		"/etc/kubernetes/static-pod-resources/kube-apiserver-pod-3/secrets/etcd-client/tls.crt":              "cert",
+		"/etc/kubernetes/static-pod-resources/kube-apiserver-pod-3/secrets/etcd-client/tls.key":              "key",
+		"/etc/kubernetes/static-pod-resources/etcd-member/system:etcd-peer:master-0.crt":                     "peer cert",
+		"/var/lib/etcd/member/snap/db": "old db",
+	}
+	for name, data := range files {
+		if err := fs.WriteFile(name, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o := DefaultOptions()
+	o.AssetDir = "/assets"
+	o.FS = fs
+	o.Runtime = &FakeRuntime{Containers: []Container{
+		{ID: "1", Name: "etcd-member", PodName: "etcd-member-master-0", Namespace: "openshift-etcd"},
+		{ID: "2", Name: "kube-apiserver-2", PodName: "kube-apiserver-master-0", Namespace: "openshift-kube-apiserver"},
+	}}
+	return o
+}
+
+func replaceStep(t *testing.T, wf *Workflow, name string, do func(ctx context.Context) error) {
+	for i := range wf.Steps {
+		if wf.Steps[i].Name == name {
+			wf.Steps[i].Do = do
+			return
+		}
+	}
+	t.Fatalf("no %s step", name)
+}
+
+// fakeRestore replaces the steps that need a real snapshot and the host's
+// etcd with ones that write a marker db into the data-dir.
+func fakeRestore(t *testing.T, wf *Workflow, o *Options, err error) {
+	replaceStep(t, wf, "verify snapshot", func(ctx context.Context) error { return nil })
+	replaceStep(t, wf, "wait for etcd to stop", func(ctx context.Context) error { return nil })
+	replaceStep(t, wf, "restore snapshot", func(ctx context.Context) error {
+		if err != nil {
+			return err
+		}
+		return o.FS.(*MemFS).WriteFile(o.DataDir()+"/member/snap/db", []byte("restored db"), 0600)
+	})
+}
+
+// failingFS fails to open the files in fail for writing.
+type failingFS struct {
+	*MemFS
+	fail map[string]bool
+}
+
+func (f failingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if f.fail[name] && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, errors.New("disk full")
+	}
+	return f.MemFS.OpenFile(name, flag, perm)
+}
+
+func readString(t *testing.T, fs FS, name string) string {
+	data, err := readFile(fs, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRecoverWorkflow(t *testing.T) {
+	o := newTestMaster(t)
+	wf := RecoverWorkflow(o, RecoverConfig{SnapshotPath: "/root/snapshot.db"})
+	fakeRestore(t, wf, o, nil)
+	if err := wf.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readString(t, o.FS, o.DataDir()+"/member/snap/db"); got != "restored db" {
+		t.Errorf("data-dir db = %q, want restored db", got)
+	}
+	for _, name := range []string{
+		"etcd-member.yaml", "etcd.conf", "etcd/member/snap/db", "system:etcd-peer:master-0.crt",
+	} {
+		if !fileExists(o.FS, o.BackupPath(name)) {
+			t.Errorf("backup of %s missing", name)
+		}
+	}
+	if got := readString(t, o.FS, o.BackupPath("etcd/member/snap/db")); got != "old db" {
+		t.Errorf("data-dir backup db = %q, want old db", got)
+	}
+	if !fileExists(o.FS, o.EtcdManifest()) {
+		t.Error("etcd manifest was not moved back")
+	}
+}
+
+func TestRecoverWorkflowRollback(t *testing.T) {
+	o := newTestMaster(t)
+	wf := RecoverWorkflow(o, RecoverConfig{SnapshotPath: "/root/snapshot.db"})
+	fakeRestore(t, wf, o, errors.New("corrupt snapshot"))
+	if err := wf.Run(context.Background()); err == nil {
+		t.Fatal("expected recovery to fail")
+	}
+
+	if got := readString(t, o.FS, o.DataDir()+"/member/snap/db"); got != "old db" {
+		t.Errorf("data-dir db = %q, want old db to be put back", got)
+	}
+	if !fileExists(o.FS, o.EtcdManifest()) || fileExists(o.FS, o.StoppedEtcdManifest()) {
+		t.Error("etcd was not started again")
+	}
+}
+
+func TestRecoverWorkflowRollbackAfterStart(t *testing.T) {
+	o := newTestMaster(t)
+	wf := RecoverWorkflow(o, RecoverConfig{SnapshotPath: "/root/snapshot.db"})
+	fakeRestore(t, wf, o, nil)
+	replaceStep(t, wf, "wait for etcd to become healthy", func(ctx context.Context) error {
+		return errors.New("etcd member is not healthy")
+	})
+	for i := range wf.Steps {
+		if step := &wf.Steps[i]; step.Name == "remove etcd data-dir" {
+			undo := step.Undo
+			step.Undo = func(ctx context.Context) error {
+				if fileExists(o.FS, o.EtcdManifest()) {
+					t.Error("data-dir put back while etcd is running")
+				}
+				return undo(ctx)
+			}
+		}
+	}
+	if err := wf.Run(context.Background()); err == nil {
+		t.Fatal("expected recovery to fail")
+	}
+
+	if got := readString(t, o.FS, o.DataDir()+"/member/snap/db"); got != "old db" {
+		t.Errorf("data-dir db = %q, want old db to be put back", got)
+	}
+	if !fileExists(o.FS, o.EtcdManifest()) || fileExists(o.FS, o.StoppedEtcdManifest()) {
+		t.Error("etcd was not started again")
+	}
+}
+
+func TestRecoverWorkflowFailedDataDirBackup(t *testing.T) {
+	o := newTestMaster(t)
+	o.FS = failingFS{o.FS.(*MemFS), map[string]bool{o.BackupPath("etcd/member/snap/db"): true}}
+	wf := RecoverWorkflow(o, RecoverConfig{SnapshotPath: "/root/snapshot.db"})
+	fakeRestore(t, wf, o, nil)
+	if err := wf.Run(context.Background()); err == nil {
+		t.Fatal("expected recovery to fail")
+	}
+
+	if got := readString(t, o.FS, o.DataDir()+"/member/snap/db"); got != "old db" {
+		t.Errorf("data-dir db = %q, want old db to be kept", got)
+	}
+	if _, err := o.FS.Stat(o.BackupPath("etcd")); !os.IsNotExist(err) {
+		t.Errorf("partial data-dir backup left behind (%v)", err)
+	}
+}
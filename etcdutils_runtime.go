@@ -0,0 +1,201 @@
+package etcdutils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Container is a running container as reported by the CRI runtime.
+type Container struct {
+	ID        string
+	Name      string
+	PodName   string
+	Namespace string
+}
+
+func (c Container) String() string {
+	return fmt.Sprintf("%s/%s/%s (%s)", c.Namespace, c.PodName, c.Name, c.ID)
+}
+
+// ContainerFilter selects containers by pod namespace and pod name prefix.
+// Empty fields match everything.
+type ContainerFilter struct {
+	Namespace     string
+	PodNamePrefix string
+}
+
+func (f ContainerFilter) String() string {
+	return fmt.Sprintf("%s/%s*", f.Namespace, f.PodNamePrefix)
+}
+
+func (f ContainerFilter) Match(c Container) bool {
+	return (f.Namespace == "" || c.Namespace == f.Namespace) &&
+		strings.HasPrefix(c.PodName, f.PodNamePrefix)
+}
+
+var (
+	EtcdContainers          = ContainerFilter{Namespace: "openshift-etcd", PodNamePrefix: "etcd-member"}
+	KubeAPIServerContainers = ContainerFilter{Namespace: "openshift-kube-apiserver", PodNamePrefix: "kube-apiserver"}
+)
+
+// ContainerRuntime lists and stops the containers of the node.
+type ContainerRuntime interface {
+	// ListContainers returns the running containers that match filter.
+	ListContainers(ctx context.Context, filter ContainerFilter) ([]Container, error)
+	StopContainer(ctx context.Context, id string, timeout time.Duration) error
+}
+
+const containerStopTimeout = 30 * time.Second
+
+// StopAllContainers stops every running container matching one of the
+// filters and returns the containers that are still running afterwards.
+// A dry run that cannot list the containers, e.g. on a host without crictl,
+// plans to stop all containers of the filter instead of failing.
+func StopAllContainers(ctx context.Context, o *Options, filters ...ContainerFilter) ([]Container, error) {
+	rt := o.runtime()
+	var containers []Container
+	for _, filter := range filters {
+		matched, err := rt.ListContainers(ctx, filter)
+		if err != nil && o.DryRun() {
+			o.planned(ActionStopContainer, filter.String(), fmt.Sprintf("could not list containers: %v", err))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, matched...)
+	}
+	for _, c := range containers {
+		if o.planned(ActionStopContainer, c.String(), "") {
+			continue
+		}
+		log.Printf("Stopping container %s..\n", c)
+		if err := rt.StopContainer(ctx, c.ID, containerStopTimeout); err != nil {
+			log.Printf("Error stopping container %s: %v\n", c, err)
+		}
+	}
+	if o.DryRun() {
+		return nil, nil
+	}
+
+	var running []Container
+	for _, filter := range filters {
+		matched, err := rt.ListContainers(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		running = append(running, matched...)
+	}
+	if len(running) != 0 {
+		names := make([]string, len(running))
+		for i, c := range running {
+			names[i] = c.String()
+		}
+		return running, fmt.Errorf("containers still running: %s", strings.Join(names, ", "))
+	}
+	return nil, nil
+}
+
+// CrictlRuntime talks to the CRI runtime through crictl.
+type CrictlRuntime struct{}
+
+func (CrictlRuntime) run(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "crictl", args...)
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("crictl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("crictl %s: %v", strings.Join(args, " "), err)
+	}
+	return out, nil
+}
+
+func (r CrictlRuntime) ListContainers(ctx context.Context, filter ContainerFilter) ([]Container, error) {
+	args := []string{"ps", "--output", "json"}
+	if filter.Namespace != "" {
+		args = append(args, "--label", "io.kubernetes.pod.namespace="+filter.Namespace)
+	}
+	out, err := r.run(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Containers []struct {
+			ID       string `json:"id"`
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Labels map[string]string `json:"labels"`
+		} `json:"containers"`
+	}
+	if err = json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("could not parse crictl ps output (%v)", err)
+	}
+	var containers []Container
+	for _, c := range resp.Containers {
+		container := Container{
+			ID:        c.ID,
+			Name:      c.Metadata.Name,
+			PodName:   c.Labels["io.kubernetes.pod.name"],
+			Namespace: c.Labels["io.kubernetes.pod.namespace"],
+		}
+		if filter.Match(container) {
+			containers = append(containers, container)
+		}
+	}
+	return containers, nil
+}
+
+func (r CrictlRuntime) StopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	_, err := r.run(ctx, "stop", "--timeout", fmt.Sprint(int(timeout.Seconds())), id)
+	return err
+}
+
+// FakeRuntime keeps containers in memory for tests. Containers whose ID is
+// in Stuck keep running when stopped. ListErr, when set, fails every
+// listing.
+type FakeRuntime struct {
+	mu         sync.Mutex
+	Containers []Container
+	Stuck      map[string]bool
+	Stopped    []string
+	ListErr    error
+}
+
+func (f *FakeRuntime) ListContainers(ctx context.Context, filter ContainerFilter) ([]Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ListErr != nil {
+		return nil, f.ListErr
+	}
+	var containers []Container
+	for _, c := range f.Containers {
+		if filter.Match(c) {
+			containers = append(containers, c)
+		}
+	}
+	return containers, nil
+}
+
+func (f *FakeRuntime) StopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Stopped = append(f.Stopped, id)
+	if f.Stuck[id] {
+		return fmt.Errorf("container %s did not stop within %v", id, timeout)
+	}
+	for i, c := range f.Containers {
+		if c.ID == id {
+			f.Containers = append(f.Containers[:i], f.Containers[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("container %s not found", id)
+}
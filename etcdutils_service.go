@@ -0,0 +1,230 @@
+package etcdutils
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+// ServiceManager controls the systemd units of the node, kubelet.service in
+// particular.
+type ServiceManager interface {
+	Stop(ctx context.Context, name string) error
+	Start(ctx context.Context, name string) error
+	// Reload makes the manager pick up changed unit files.
+	Reload(ctx context.Context) error
+	// Status returns the ActiveState of the unit, e.g. "active" or "inactive".
+	Status(ctx context.Context, name string) (string, error)
+	IsActive(ctx context.Context, name string) (bool, error)
+}
+
+// isActiveState reports whether a unit in the given ActiveState still has
+// processes running.
+func isActiveState(state string) bool {
+	switch state {
+	case "active", "reloading", "activating", "deactivating":
+		return true
+	}
+	return false
+}
+
+// waitForInactive polls the unit until it has stopped or ctx is done.
+func waitForInactive(ctx context.Context, sm ServiceManager, name string) error {
+	for {
+		state, err := sm.Status(ctx, name)
+		if err != nil {
+			return err
+		}
+		if !isActiveState(state) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s still %s: %v", name, state, ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// SystemctlManager controls units by running systemctl.
+type SystemctlManager struct{}
+
+func (SystemctlManager) run(ctx context.Context, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, "systemctl", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("systemctl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (s SystemctlManager) Stop(ctx context.Context, name string) error {
+	_, err := s.run(ctx, "stop", name)
+	return err
+}
+
+func (s SystemctlManager) Start(ctx context.Context, name string) error {
+	_, err := s.run(ctx, "start", name)
+	return err
+}
+
+func (s SystemctlManager) Reload(ctx context.Context) error {
+	_, err := s.run(ctx, "daemon-reload")
+	return err
+}
+
+func (s SystemctlManager) Status(ctx context.Context, name string) (string, error) {
+	return s.run(ctx, "show", "--property=ActiveState", "--value", name)
+}
+
+func (s SystemctlManager) IsActive(ctx context.Context, name string) (bool, error) {
+	state, err := s.Status(ctx, name)
+	return isActiveState(state), err
+}
+
+// DBusManager controls units through the systemd D-Bus API.
+type DBusManager struct{}
+
+func (DBusManager) job(ctx context.Context, name string, start func(*dbus.Conn, chan<- string) (int, error)) error {
+	conn, err := dbus.New()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch := make(chan string, 1)
+	if _, err = start(conn, ch); err != nil {
+		return err
+	}
+	select {
+	case result := <-ch:
+		if result != "done" {
+			return fmt.Errorf("systemd job for %s finished with result %q", name, result)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d DBusManager) Stop(ctx context.Context, name string) error {
+	return d.job(ctx, name, func(conn *dbus.Conn, ch chan<- string) (int, error) {
+		return conn.StopUnit(name, "replace", ch)
+	})
+}
+
+func (d DBusManager) Start(ctx context.Context, name string) error {
+	return d.job(ctx, name, func(conn *dbus.Conn, ch chan<- string) (int, error) {
+		return conn.StartUnit(name, "replace", ch)
+	})
+}
+
+func (DBusManager) Reload(ctx context.Context) error {
+	conn, err := dbus.New()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Reload()
+}
+
+func (DBusManager) Status(ctx context.Context, name string) (string, error) {
+	conn, err := dbus.New()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	prop, err := conn.GetUnitProperty(name, "ActiveState")
+	if err != nil {
+		return "", err
+	}
+	state, ok := prop.Value.Value().(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected ActiveState %v for %s", prop.Value, name)
+	}
+	return state, nil
+}
+
+func (d DBusManager) IsActive(ctx context.Context, name string) (bool, error) {
+	state, err := d.Status(ctx, name)
+	return isActiveState(state), err
+}
+
+// FakeServiceManager keeps unit states in memory for tests. A unit that is
+// stopped reports "deactivating" for StopDelay Status calls before it
+// becomes "inactive".
+type FakeServiceManager struct {
+	mu        sync.Mutex
+	States    map[string]string
+	Calls     []string
+	StopDelay int
+	Err       error
+
+	stopping map[string]int
+}
+
+func (f *FakeServiceManager) call(c string) error {
+	f.Calls = append(f.Calls, c)
+	if f.States == nil {
+		f.States = map[string]string{}
+	}
+	if f.stopping == nil {
+		f.stopping = map[string]int{}
+	}
+	return f.Err
+}
+
+func (f *FakeServiceManager) Stop(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("stop " + name); err != nil {
+		return err
+	}
+	f.States[name] = "deactivating"
+	f.stopping[name] = f.StopDelay
+	return nil
+}
+
+func (f *FakeServiceManager) Start(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("start " + name); err != nil {
+		return err
+	}
+	f.States[name] = "active"
+	return nil
+}
+
+func (f *FakeServiceManager) Reload(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.call("daemon-reload")
+}
+
+func (f *FakeServiceManager) Status(ctx context.Context, name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("status " + name); err != nil {
+		return "", err
+	}
+	if f.States[name] == "deactivating" {
+		if f.stopping[name] <= 0 {
+			f.States[name] = "inactive"
+		}
+		f.stopping[name]--
+	}
+	if state, ok := f.States[name]; ok {
+		return state, nil
+	}
+	return "inactive", nil
+}
+
+func (f *FakeServiceManager) IsActive(ctx context.Context, name string) (bool, error) {
+	state, err := f.Status(ctx, name)
+	return isActiveState(state), err
+}
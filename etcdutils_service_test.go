@@ -0,0 +1,36 @@
+package etcdutils
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestStopKubeletWaitsForInactive(t *testing.T) {
+	sm := &FakeServiceManager{States: map[string]string{"kubelet.service": "active"}, StopDelay: 1}
+	o := DefaultOptions()
+	o.Services = sm
+	if err := StopKubelet(context.Background(), o); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"stop kubelet.service", "status kubelet.service", "status kubelet.service"}
+	if !reflect.DeepEqual(sm.Calls, want) {
+		t.Errorf("calls = %v, want %v", sm.Calls, want)
+	}
+	if sm.States["kubelet.service"] != "inactive" {
+		t.Errorf("kubelet is %s, want inactive", sm.States["kubelet.service"])
+	}
+}
+
+func TestStartKubeletReloadError(t *testing.T) {
+	sm := &FakeServiceManager{Err: errors.New("daemon-reload failed")}
+	o := DefaultOptions()
+	o.Services = sm
+	if err := StartKubelet(context.Background(), o); err == nil {
+		t.Fatal("expected daemon-reload error to be returned")
+	}
+	if want := []string{"daemon-reload"}; !reflect.DeepEqual(sm.Calls, want) {
+		t.Errorf("calls = %v, want %v", sm.Calls, want)
+	}
+}
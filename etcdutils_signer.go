@@ -0,0 +1,400 @@
+package etcdutils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	csrAPIVersion = "certificates.k8s.io/v1beta1"
+	csrPath       = "/apis/" + csrAPIVersion + "/certificatesigningrequests"
+
+	// csrWatchTimeout ends watches that do not ask for a timeout.
+	csrWatchTimeout = 30 * time.Minute
+)
+
+// signerOrgs maps the organizations the signer issues certs for to the
+// prefix their common name must have.
+var signerOrgs = map[string]string{
+	"system:etcd-peers":   "system:etcd-peer:",
+	"system:etcd-servers": "system:etcd-server:",
+	"system:etcd-metrics": "system:etcd-metric:",
+}
+
+// certificateSigningRequest is the part of a Kubernetes
+// certificates.k8s.io/v1beta1 CertificateSigningRequest the signer uses.
+type certificateSigningRequest struct {
+	APIVersion string                 `json:"apiVersion"`
+	Kind       string                 `json:"kind"`
+	Metadata   map[string]interface{} `json:"metadata"`
+	Spec       struct {
+		Request  []byte   `json:"request"`
+		Usages   []string `json:"usages,omitempty"`
+		Username string   `json:"username,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Conditions  []csrCondition `json:"conditions,omitempty"`
+		Certificate []byte         `json:"certificate,omitempty"`
+	} `json:"status"`
+
+	resourceVersion uint64
+}
+
+func (csr *certificateSigningRequest) name() string {
+	name, _ := csr.Metadata["name"].(string)
+	return name
+}
+
+type csrWatchEvent struct {
+	Type   string                     `json:"type"`
+	Object *certificateSigningRequest `json:"object"`
+}
+
+type csrCondition struct {
+	Type           string `json:"type"`
+	Reason         string `json:"reason,omitempty"`
+	Message        string `json:"message,omitempty"`
+	LastUpdateTime string `json:"lastUpdateTime,omitempty"`
+}
+
+// Signer serves the CertificateSigningRequest API the cert recovery agent
+// requests etcd member certs from, and signs them with the etcd CA. It
+// serves create, get, list and watch as used by client-go's
+// csr.RequestCertificate and csr.WaitForCertificate.
+type Signer struct {
+	CA       *CertAuthority
+	Validity time.Duration
+
+	mu   sync.Mutex
+	csrs map[string]*certificateSigningRequest
+	// rv is the resource version of the latest CSR, changed is closed and
+	// replaced whenever one is added.
+	rv      uint64
+	changed chan struct{}
+}
+
+func NewSigner(ca *CertAuthority) *Signer {
+	return &Signer{
+		CA:       ca,
+		Validity: memberCertValidity,
+		csrs:     map[string]*certificateSigningRequest{},
+		changed:  make(chan struct{}),
+	}
+}
+
+// SignCSR signs the PEM encoded certificate request of an etcd peer, server
+// or metric cert and returns the PEM encoded cert.
+func (s *Signer) SignCSR(csrPEM []byte) ([]byte, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("no certificate request found")
+	}
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err = req.CheckSignature(); err != nil {
+		return nil, err
+	}
+	if len(req.Subject.Organization) != 1 {
+		return nil, fmt.Errorf("request must have exactly one organization, got %v", req.Subject.Organization)
+	}
+	org := req.Subject.Organization[0]
+	prefix, ok := signerOrgs[org]
+	if !ok {
+		return nil, fmt.Errorf("organization %q is not signed by the etcd signer", org)
+	}
+	if !strings.HasPrefix(req.Subject.CommonName, prefix) {
+		return nil, fmt.Errorf("common name %q of %s must start with %s", req.Subject.CommonName, org, prefix)
+	}
+
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: req.Subject.CommonName, Organization: req.Subject.Organization},
+		DNSNames:    req.DNSNames,
+		IPAddresses: req.IPAddresses,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	return s.CA.Sign(tmpl, req.PublicKey, s.Validity)
+}
+
+func (s *Signer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == csrPath && r.Method == http.MethodPost:
+		s.handlePost(w, r)
+	case r.URL.Path == csrPath && r.Method == http.MethodGet:
+		s.handleList(w, r)
+	case strings.HasPrefix(r.URL.Path, csrPath+"/") && r.Method == http.MethodGet:
+		s.mu.Lock()
+		csr, ok := s.csrs[strings.TrimPrefix(r.URL.Path, csrPath+"/")]
+		s.mu.Unlock()
+		if !ok {
+			writeStatus(w, http.StatusNotFound, "NotFound", "certificatesigningrequest not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, csr)
+	default:
+		writeStatus(w, http.StatusNotFound, "NotFound", r.Method+" "+r.URL.Path+" is not served")
+	}
+}
+
+func (s *Signer) handlePost(w http.ResponseWriter, r *http.Request) {
+	csr := &certificateSigningRequest{}
+	if err := json.NewDecoder(r.Body).Decode(csr); err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+	if csr.Metadata == nil {
+		csr.Metadata = map[string]interface{}{}
+	}
+	name := csr.name()
+	if name == "" {
+		suffix := make([]byte, 4)
+		rand.Read(suffix)
+		generateName, _ := csr.Metadata["generateName"].(string)
+		name = generateName + hex.EncodeToString(suffix)
+		csr.Metadata["name"] = name
+	}
+	if s.exists(name) {
+		writeStatus(w, http.StatusConflict, "AlreadyExists", fmt.Sprintf("certificatesigningrequest %q already exists", name))
+		return
+	}
+
+	cert, err := s.SignCSR(csr.Spec.Request)
+	if err != nil {
+		log.Printf("Denied certificate signing request %s: %v\n", name, err)
+		writeStatus(w, http.StatusForbidden, "Forbidden", err.Error())
+		return
+	}
+	csr.APIVersion = csrAPIVersion
+	csr.Kind = "CertificateSigningRequest"
+	csr.Status.Conditions = []csrCondition{{
+		Type:           "Approved",
+		Reason:         "AutoApproved",
+		Message:        "signed by the etcd recovery signer",
+		LastUpdateTime: time.Now().UTC().Format(time.RFC3339),
+	}}
+	csr.Status.Certificate = cert
+
+	if !s.add(csr) {
+		writeStatus(w, http.StatusConflict, "AlreadyExists", fmt.Sprintf("certificatesigningrequest %q already exists", name))
+		return
+	}
+	log.Printf("Signed certificate signing request %s\n", name)
+	writeJSON(w, http.StatusCreated, csr)
+}
+
+func (s *Signer) exists(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.csrs[name]
+	return ok
+}
+
+// add stores csr under a new resource version and wakes up the watches. It
+// reports false if a CSR of the same name was added in the meantime.
+func (s *Signer) add(csr *certificateSigningRequest) bool {
+	uid := make([]byte, 16)
+	rand.Read(uid)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.csrs[csr.name()]; ok {
+		return false
+	}
+	s.rv++
+	csr.resourceVersion = s.rv
+	csr.Metadata["resourceVersion"] = strconv.FormatUint(s.rv, 10)
+	csr.Metadata["uid"] = fmt.Sprintf("%x-%x-%x-%x-%x", uid[:4], uid[4:6], uid[6:8], uid[8:10], uid[10:])
+	csr.Metadata["creationTimestamp"] = time.Now().UTC().Format(time.RFC3339)
+	s.csrs[csr.name()] = csr
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return true
+}
+
+// since returns the CSRs named name, or all of them if name is empty, that
+// were added after resource version rv, in the order they were added. It
+// also returns the latest resource version and the channel closed on the
+// next change.
+func (s *Signer) since(name string, rv uint64) ([]*certificateSigningRequest, uint64, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	csrs := []*certificateSigningRequest{}
+	for _, csr := range s.csrs {
+		if (name == "" || csr.name() == name) && csr.resourceVersion > rv {
+			csrs = append(csrs, csr)
+		}
+	}
+	sort.Slice(csrs, func(i, j int) bool { return csrs[i].resourceVersion < csrs[j].resourceVersion })
+	return csrs, s.rv, s.changed
+}
+
+// csrFieldSelector returns the name selected by the fieldSelector of r, or
+// "" if there is none. Only metadata.name is supported, the one field
+// client-go selects CSRs by.
+func csrFieldSelector(r *http.Request) (string, error) {
+	selector := r.URL.Query().Get("fieldSelector")
+	if selector == "" {
+		return "", nil
+	}
+	for _, op := range []string{"==", "="} {
+		if strings.HasPrefix(selector, "metadata.name"+op) {
+			return strings.TrimPrefix(selector, "metadata.name"+op), nil
+		}
+	}
+	return "", fmt.Errorf("unsupported field selector %q", selector)
+}
+
+func (s *Signer) handleList(w http.ResponseWriter, r *http.Request) {
+	name, err := csrFieldSelector(r)
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+	if watch := r.URL.Query().Get("watch"); watch == "true" || watch == "1" {
+		s.handleWatch(w, r, name)
+		return
+	}
+	csrs, rv, _ := s.since(name, 0)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"apiVersion": csrAPIVersion,
+		"kind":       "CertificateSigningRequestList",
+		"metadata":   map[string]interface{}{"resourceVersion": strconv.FormatUint(rv, 10)},
+		"items":      csrs,
+	})
+}
+
+// handleWatch streams an ADDED event for every CSR added after the requested
+// resource version until the client goes away or the watch times out. CSRs
+// are signed when they are created and never change, so there are no other
+// events.
+func (s *Signer) handleWatch(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+	rv, _ := strconv.ParseUint(query.Get("resourceVersion"), 10, 64)
+	timeout := csrWatchTimeout
+	if seconds, err := strconv.Atoi(query.Get("timeoutSeconds")); err == nil && seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	for {
+		csrs, latest, changed := s.since(name, rv)
+		for _, csr := range csrs {
+			if err := enc.Encode(csrWatchEvent{Type: "ADDED", Object: csr}); err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		rv = latest
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeStatus writes a Kubernetes Status error the client libraries can
+// decode.
+func writeStatus(w http.ResponseWriter, code int, reason, message string) {
+	writeJSON(w, code, map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Status",
+		"status":     "Failure",
+		"message":    message,
+		"reason":     reason,
+		"code":       code,
+	})
+}
+
+// TLSConfig returns the server TLS config of the signer. Its serving cert
+// is issued by the CA for ips, and clients must present a cert the CA
+// signed, like the etcd client cert in the recovery kubeconfig.
+func (s *Signer) TLSConfig(ips []string) (*tls.Config, error) {
+	key, err := rsa.GenerateKey(rand.Reader, memberKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "etcd-recovery-signer"},
+		DNSNames:    []string{"localhost"},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, addr := range append([]string{"127.0.0.1"}, ips...) {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", addr)
+		}
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+	}
+	certPEM, err := s.CA.Sign(tmpl, &key.PublicKey, 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(s.CA.Cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// ServeSigner serves s over HTTPS on addr until ctx is done. ips are the
+// addresses clients reach the signer on, usually RECOVERY_SERVER_IP.
+func ServeSigner(ctx context.Context, s *Signer, addr string, ips []string) error {
+	tlsConfig, err := s.TLSConfig(ips)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Addr: addr, Handler: s, TLSConfig: tlsConfig}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	log.Printf("Serving etcd certificate signer on %s\n", addr)
+	if err = srv.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package etcdutils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	certificates "k8s.io/api/certificates/v1beta1"
+	certificatesclient "k8s.io/client-go/kubernetes/typed/certificates/v1beta1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/certificate/csr"
+)
+
+func newTestCSRPEM(t *testing.T, cn, org string) ([]byte, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: cn, Organization: []string{org}},
+		DNSNames:    []string{"etcd-0.cluster.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), key
+}
+
+func newTestCSR(t *testing.T, cn, org string) map[string]interface{} {
+	csrPEM, _ := newTestCSRPEM(t, cn, org)
+	return map[string]interface{}{
+		"apiVersion": "certificates.k8s.io/v1beta1",
+		"kind":       "CertificateSigningRequest",
+		"metadata":   map[string]interface{}{"name": cn},
+		"spec": map[string]interface{}{
+			"request": csrPEM,
+			"usages":  []string{"server auth", "client auth"},
+		},
+	}
+}
+
+func startTestSigner(t *testing.T, ca *testCert) *httptest.Server {
+	signer := NewSigner(&CertAuthority{Cert: ca.cert, Key: ca.key})
+	srv := httptest.NewUnstartedServer(signer)
+	tlsConfig, err := signer.TLSConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	return srv
+}
+
+func TestSigner(t *testing.T) {
+	ca := newTestCert(t, nil, "etcd-signer")
+	client := newTestCert(t, ca, "etcd")
+	srv := startTestSigner(t, ca)
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientCert, err := tls.X509KeyPair(client.certPEM, client.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert},
+	}}}
+
+	post := func(csr map[string]interface{}) (*http.Response, certificateSigningRequest) {
+		data, _ := json.Marshal(csr)
+		resp, err := cli.Post(srv.URL+csrPath, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out certificateSigningRequest
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp, out
+	}
+
+	resp, out := post(newTestCSR(t, "system:etcd-peer:etcd-0.cluster.example.com", "system:etcd-peers"))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST returned %s", resp.Status)
+	}
+	if len(out.Status.Conditions) != 1 || out.Status.Conditions[0].Type != "Approved" {
+		t.Errorf("conditions = %+v", out.Status.Conditions)
+	}
+	certs, err := parseCertsPEM(out.Status.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = certs[0].Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}); err != nil {
+		t.Errorf("signed cert does not verify: %v", err)
+	}
+	if len(certs[0].IPAddresses) != 1 || certs[0].DNSNames[0] != "etcd-0.cluster.example.com" {
+		t.Errorf("SANs not copied: %v %v", certs[0].DNSNames, certs[0].IPAddresses)
+	}
+
+	get, err := cli.Get(srv.URL + csrPath + "/system:etcd-peer:etcd-0.cluster.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get.Body.Close()
+	if get.StatusCode != http.StatusOK {
+		t.Errorf("GET returned %s", get.Status)
+	}
+	if resp, _ = post(newTestCSR(t, "system:etcd-peer:etcd-0.cluster.example.com", "system:etcd-peers")); resp.StatusCode != http.StatusConflict {
+		t.Errorf("request with a duplicate name returned %s", resp.Status)
+	}
+
+	watch, err := cli.Get(srv.URL + csrPath + "?watch=true&resourceVersion=1&fieldSelector=metadata.name%3Dsystem:etcd-metric:etcd-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watch.Body.Close()
+	post(newTestCSR(t, "system:etcd-server:etcd-1", "system:etcd-servers"))
+	post(newTestCSR(t, "system:etcd-metric:etcd-1", "system:etcd-metrics"))
+	var event csrWatchEvent
+	if err = json.NewDecoder(bufio.NewReader(watch.Body)).Decode(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != "ADDED" || event.Object.name() != "system:etcd-metric:etcd-1" {
+		t.Errorf("watch sent %s %s, want the CSR added after it started", event.Type, event.Object.name())
+	}
+
+	if resp, _ = post(newTestCSR(t, "system:etcd-peer:etcd-0", "system:masters")); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("request for system:masters returned %s", resp.Status)
+	}
+	if resp, _ = post(newTestCSR(t, "system:etcd-server:etcd-0", "system:etcd-peers")); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("request with mismatched common name returned %s", resp.Status)
+	}
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if _, err = anonymous.Get(srv.URL + csrPath + "/x"); err == nil {
+		t.Error("request without client cert was served")
+	}
+}
+
+func TestSignerClientGo(t *testing.T) {
+	ca := newTestCert(t, nil, "etcd-signer")
+	client := newTestCert(t, ca, "etcd")
+	srv := startTestSigner(t, ca)
+	defer srv.Close()
+
+	cs, err := certificatesclient.NewForConfig(&rest.Config{
+		Host: srv.URL,
+		TLSClientConfig: rest.TLSClientConfig{
+			CAData:   ca.certPEM,
+			CertData: client.certPEM,
+			KeyData:  client.keyPEM,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrs := cs.CertificateSigningRequests()
+	name := "system:etcd-server:etcd-0.cluster.example.com"
+	csrPEM, key := newTestCSRPEM(t, name, "system:etcd-servers")
+	usages := []certificates.KeyUsage{certificates.UsageServerAuth, certificates.UsageClientAuth}
+
+	// The second request finds the first one and reuses it, like an agent
+	// that is restarted.
+	for i := 0; i < 2; i++ {
+		req, err := csr.RequestCertificate(csrs, csrPEM, name, usages, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		certPEM, err := csr.WaitForCertificate(ctx, csrs, req)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs, err := parseCertsPEM(certPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if certs[0].Subject.CommonName != name {
+			t.Errorf("signed %s, want %s", certs[0].Subject.CommonName, name)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package etcdutils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// SnapshotMetadata is written next to a saved snapshot as <db>.json.
+type SnapshotMetadata struct {
+	Endpoint  string `json:"endpoint"`
+	MemberID  string `json:"memberID"`
+	ClusterID string `json:"clusterID"`
+	// Revision, RaftTerm and TotalKeys are queried from the member right
+	// before the snapshot is streamed, so writes committed in between are
+	// in the snapshot but not counted here.
+	Revision  int64  `json:"revision"`
+	RaftTerm  uint64 `json:"raftTerm"`
+	TotalKeys int64  `json:"totalKeys"`
+	// Size and SHA256 are those of the file as written, after compression
+	// and encryption.
+	Size int64 `json:"size"`
+	// DBSize is the size of the plain db streamed by etcd, including the
+	// sha256 etcd appends to it.
+	DBSize      int64     `json:"dbSize"`
+	Compression string    `json:"compression,omitempty"`
+	Encrypted   bool      `json:"encrypted,omitempty"`
+	SHA256      string    `json:"sha256"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// SnapshotMetadataPath returns the path of the metadata sidecar of the
+// snapshot at dbPath.
+func SnapshotMetadataPath(dbPath string) string {
+	return dbPath + ".json"
+}
+
+func writeSnapshotMetadata(fs FS, dbPath string, meta *SnapshotMetadata) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fs, SnapshotMetadataPath(dbPath), append(data, '\n'), 0600)
+}
+
+// ReadSnapshotMetadata reads the sidecar of the snapshot at dbPath, which
+// is resolved below the root of o.
+func ReadSnapshotMetadata(o *Options, dbPath string) (*SnapshotMetadata, error) {
+	return readSnapshotMetadata(o.fs(), o.resolve(dbPath))
+}
+
+func readSnapshotMetadata(fs FS, dbPath string) (*SnapshotMetadata, error) {
+	data, err := readFile(fs, SnapshotMetadataPath(dbPath))
+	if err != nil {
+		return nil, err
+	}
+	meta := &SnapshotMetadata{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("could not parse %s (%v)", SnapshotMetadataPath(dbPath), err)
+	}
+	return meta, nil
+}
+
+// snapshotDigest is the sha256 and size of a snapshot file as stored.
+type snapshotDigest struct {
+	sha256 string
+	size   int64
+}
+
+// checkSnapshotHash verifies the sha256 etcd appends to the snapshots it
+// streams, like etcdctl does on restore, decrypting and decompressing the
+// snapshot if needed. It reports whether the snapshot has a hash at all and
+// returns the digest of the file, read in the same pass.
+func checkSnapshotHash(fs FS, path string, key *SnapshotKey) (bool, snapshotDigest, error) {
+	var digest snapshotDigest
+	f, err := fs.Open(path)
+	if err != nil {
+		return false, digest, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	raw := &countingWriter{w: h}
+	tee := io.TeeReader(f, raw)
+	r, _, err := newSnapshotReader(tee, key)
+	if err != nil {
+		return false, digest, fmt.Errorf("could not read snapshot %s (%v)", path, err)
+	}
+	defer r.Close()
+
+	w := newSnapshotHashWriter()
+	if _, err = io.Copy(w, r); err != nil {
+		return false, digest, fmt.Errorf("could not read snapshot %s (%v)", path, err)
+	}
+	// The decoders may stop short of the end of the file.
+	if _, err = io.Copy(ioutil.Discard, tee); err != nil {
+		return false, digest, err
+	}
+	digest = snapshotDigest{hex.EncodeToString(h.Sum(nil)), raw.n}
+	hasHash, err := w.check()
+	if err != nil {
+		return true, digest, fmt.Errorf("snapshot %s is corrupt: %v", path, err)
+	}
+	return hasHash, digest, nil
+}
+
+// VerifySnapshot checks the snapshot at dbPath, resolved below the root of
+// o, against its appended hash and, if there is one, its metadata sidecar.
+// key is only needed for encrypted snapshots.
+func VerifySnapshot(o *Options, dbPath string, key *SnapshotKey) error {
+	return verifySnapshot(o.fs(), o.resolve(dbPath), key)
+}
+
+func verifySnapshot(fs FS, dbPath string, key *SnapshotKey) error {
+	hasHash, digest, err := checkSnapshotHash(fs, dbPath, key)
+	if err != nil {
+		return err
+	}
+	if !hasHash {
+		return fmt.Errorf("snapshot %s has no integrity hash", dbPath)
+	}
+
+	meta, err := readSnapshotMetadata(fs, dbPath)
+	if os.IsNotExist(err) {
+		log.Printf("No metadata found for snapshot %s, only its hash is verified\n", dbPath)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if digest.size != meta.Size || digest.sha256 != meta.SHA256 {
+		return fmt.Errorf("snapshot %s does not match %s: size %d sha256 %s, want size %d sha256 %s",
+			dbPath, SnapshotMetadataPath(dbPath), digest.size, digest.sha256, meta.Size, meta.SHA256)
+	}
+	log.Printf("Verified snapshot %s of revision %d from %s\n", dbPath, meta.Revision, meta.Endpoint)
+	return nil
+}
@@ -0,0 +1,327 @@
+package etcdutils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted snapshots start with encMagic, the kind of key and its salt or
+// the ephemeral X25519 public key, followed by the snapshot sealed with
+// AES-256-GCM in chunks of encChunkSize. Each chunk's nonce is its index
+// and a flag marking the last chunk, so chunks cannot be reordered or the
+// snapshot truncated without failing to decrypt. A key file is stretched
+// with scrypt over the salt first, as it may hold a passphrase rather than
+// a random key.
+const (
+	encMagic     = "etcdutils-enc/1\n"
+	encChunkSize = 64 * 1024
+
+	encKindKeyFile = 'k'
+	encKindX25519  = 'x'
+
+	x25519PrivateKeyType = "X25519 PRIVATE KEY"
+	x25519PublicKeyType  = "X25519 PUBLIC KEY"
+
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// SnapshotKey encrypts and decrypts snapshots, either with a secret read
+// from a key file or, like age, for the holder of an X25519 private key.
+type SnapshotKey struct {
+	secret    []byte
+	recipient *[32]byte
+	identity  *[32]byte
+}
+
+// LoadSnapshotKeyFile reads a secret of at least 16 bytes from path, which
+// is resolved below the root of o. The same file encrypts and decrypts.
+func LoadSnapshotKeyFile(o *Options, path string) (*SnapshotKey, error) {
+	path = o.resolve(path)
+	data, err := readFile(o.fs(), path)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimSpace(data)
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("key file %s must hold at least 16 bytes", path)
+	}
+	return &SnapshotKey{secret: secret}, nil
+}
+
+// LoadSnapshotRecipient reads an X25519 public key snapshots are encrypted
+// for.
+func LoadSnapshotRecipient(o *Options, path string) (*SnapshotKey, error) {
+	key, err := readX25519Key(o, path, x25519PublicKeyType)
+	if err != nil {
+		return nil, err
+	}
+	return &SnapshotKey{recipient: key}, nil
+}
+
+// LoadSnapshotIdentity reads an X25519 private key, which decrypts the
+// snapshots encrypted for its public key.
+func LoadSnapshotIdentity(o *Options, path string) (*SnapshotKey, error) {
+	key, err := readX25519Key(o, path, x25519PrivateKeyType)
+	if err != nil {
+		return nil, err
+	}
+	pub := new([32]byte)
+	curve25519.ScalarBaseMult(pub, key)
+	return &SnapshotKey{recipient: pub, identity: key}, nil
+}
+
+func readX25519Key(o *Options, path, pemType string) (*[32]byte, error) {
+	path = o.resolve(path)
+	data, err := readFile(o.fs(), path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pemType || len(block.Bytes) != 32 {
+		return nil, fmt.Errorf("no %s found in %s", pemType, path)
+	}
+	key := new([32]byte)
+	copy(key[:], block.Bytes)
+	return key, nil
+}
+
+// GenerateSnapshotIdentity writes a new X25519 private key to path and its
+// public key to path + ".pub". An existing key is never replaced, as the
+// snapshots encrypted for it could not be read anymore.
+func GenerateSnapshotIdentity(o *Options, path string) error {
+	path = o.resolve(path)
+	if fileExists(o.fs(), path) {
+		return fmt.Errorf("%s already exists", path)
+	}
+	key := new([32]byte)
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return err
+	}
+	pub := new([32]byte)
+	curve25519.ScalarBaseMult(pub, key)
+	if o.planned(ActionWrite, path, "generate snapshot identity") {
+		return nil
+	}
+	err := writeFileAtomic(o.fs(), path, pem.EncodeToMemory(&pem.Block{Type: x25519PrivateKeyType, Bytes: key[:]}), 0600)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(o.fs(), path+".pub", pem.EncodeToMemory(&pem.Block{Type: x25519PublicKeyType, Bytes: pub[:]}), 0644)
+}
+
+// encryptHeader returns the header of a snapshot encrypted with k and the
+// AEAD sealing its chunks.
+func (k *SnapshotKey) encryptHeader() ([]byte, cipher.AEAD, error) {
+	material := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, material); err != nil {
+		return nil, nil, err
+	}
+	header := []byte(encMagic)
+	if k.secret != nil {
+		header = append(append(header, encKindKeyFile), material...)
+		aead, err := newKeyFileAEAD(k.secret, material)
+		return header, aead, err
+	}
+	if k.recipient == nil {
+		return nil, nil, fmt.Errorf("snapshot key has no secret or recipient")
+	}
+	eph, ephPub := new([32]byte), new([32]byte)
+	copy(eph[:], material)
+	curve25519.ScalarBaseMult(ephPub, eph)
+	shared, err := x25519(eph, k.recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+	header = append(append(header, encKindX25519), ephPub[:]...)
+	aead, err := newSnapshotAEAD(shared, append(ephPub[:], k.recipient[:]...), "x25519")
+	return header, aead, err
+}
+
+// decryptHeader reads the rest of the header after encMagic from r and
+// returns it with the AEAD opening the chunks.
+func (k *SnapshotKey) decryptHeader(r io.Reader) ([]byte, cipher.AEAD, error) {
+	header := make([]byte, len(encMagic)+1+32)
+	copy(header, encMagic)
+	if _, err := io.ReadFull(r, header[len(encMagic):]); err != nil {
+		return nil, nil, fmt.Errorf("truncated encryption header (%v)", err)
+	}
+	kind, material := header[len(encMagic)], header[len(encMagic)+1:]
+	switch {
+	case kind == encKindKeyFile && k.secret != nil:
+		aead, err := newKeyFileAEAD(k.secret, material)
+		return header, aead, err
+	case kind == encKindX25519 && k.identity != nil:
+		ephPub := new([32]byte)
+		copy(ephPub[:], material)
+		shared, err := x25519(k.identity, ephPub)
+		if err != nil {
+			return nil, nil, err
+		}
+		aead, err := newSnapshotAEAD(shared, append(ephPub[:], k.recipient[:]...), "x25519")
+		return header, aead, err
+	case kind == encKindKeyFile:
+		return nil, nil, fmt.Errorf("snapshot is encrypted with a key file, pass the key file to read it")
+	case kind == encKindX25519:
+		return nil, nil, fmt.Errorf("snapshot is encrypted for an X25519 public key, pass its private key to read it")
+	}
+	return nil, nil, fmt.Errorf("unknown snapshot encryption %q", kind)
+}
+
+func x25519(scalar, point *[32]byte) ([]byte, error) {
+	shared := new([32]byte)
+	curve25519.ScalarMult(shared, scalar, point)
+	if *shared == [32]byte{} {
+		return nil, fmt.Errorf("invalid X25519 public key")
+	}
+	return shared[:], nil
+}
+
+func newKeyFileAEAD(secret, salt []byte) (cipher.AEAD, error) {
+	stretched, err := scrypt.Key(secret, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	return newSnapshotAEAD(stretched, salt, "key-file")
+}
+
+func newSnapshotAEAD(secret, salt []byte, info string) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte("etcdutils snapshot "+info)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(aead cipher.AEAD, counter uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// snapshotEncrypter seals what is written to it in chunks. Close writes the
+// last chunk but does not close w.
+type snapshotEncrypter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	counter uint64
+}
+
+func newSnapshotEncrypter(w io.Writer, k *SnapshotKey) (*snapshotEncrypter, error) {
+	header, aead, err := k.encryptHeader()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+	return &snapshotEncrypter{w: w, aead: aead, header: header}, nil
+}
+
+func (e *snapshotEncrypter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	// A full chunk is only sealed once more follows, so the last chunk is
+	// never empty unless the snapshot is.
+	for len(e.buf) > encChunkSize {
+		if err := e.seal(e.buf[:encChunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = append(e.buf[:0], e.buf[encChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+func (e *snapshotEncrypter) Close() error {
+	return e.seal(e.buf, true)
+}
+
+func (e *snapshotEncrypter) seal(chunk []byte, last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.aead, e.counter, last), chunk, e.header)
+	e.counter++
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// snapshotDecrypter opens the chunks sealed by snapshotEncrypter.
+type snapshotDecrypter struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	chunk   []byte
+	buf     []byte
+	counter uint64
+	done    bool
+}
+
+// newSnapshotDecrypter decrypts r, which starts right after encMagic.
+func newSnapshotDecrypter(r io.Reader, k *SnapshotKey) (*snapshotDecrypter, error) {
+	if k == nil {
+		return nil, fmt.Errorf("snapshot is encrypted, a key is needed to read it")
+	}
+	header, aead, err := k.decryptHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotDecrypter{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		header: header,
+		chunk:  make([]byte, encChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (d *snapshotDecrypter) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *snapshotDecrypter) open() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	switch err {
+	case nil:
+		_, err = d.r.Peek(1)
+		d.done = err == io.EOF
+	case io.EOF, io.ErrUnexpectedEOF:
+		d.done = true
+	default:
+		return err
+	}
+	plain, err := d.aead.Open(d.chunk[:0], chunkNonce(d.aead, d.counter, d.done), d.chunk[:n], d.header)
+	if err != nil {
+		return fmt.Errorf("could not decrypt snapshot chunk %d, wrong key or corrupt snapshot", d.counter)
+	}
+	d.counter++
+	d.buf = plain
+	return nil
+}
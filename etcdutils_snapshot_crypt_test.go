@@ -0,0 +1,129 @@
+package etcdutils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testSnapshotKeys(t *testing.T, dir string) (keyFile, recipient, identity *SnapshotKey) {
+	path := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(path, []byte("0123456789abcdef0123456789abcdef\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := LoadSnapshotKeyFile(DefaultOptions(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "identity")
+	if err = GenerateSnapshotIdentity(DefaultOptions(), path); err != nil {
+		t.Fatal(err)
+	}
+	if identity, err = LoadSnapshotIdentity(DefaultOptions(), path); err != nil {
+		t.Fatal(err)
+	}
+	if recipient, err = LoadSnapshotRecipient(DefaultOptions(), path+".pub"); err != nil {
+		t.Fatal(err)
+	}
+	return keyFile, recipient, identity
+}
+
+func encodeSnapshot(t *testing.T, plain []byte, opts SnapshotOptions) []byte {
+	var buf bytes.Buffer
+	w, err := newSnapshotWriter(&buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeSnapshotBytes(data []byte, key *SnapshotKey) ([]byte, snapshotFormat, error) {
+	r, format, err := newSnapshotReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, format, err
+	}
+	defer r.Close()
+	plain, err := ioutil.ReadAll(r)
+	return plain, format, err
+}
+
+func TestSnapshotEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile, recipient, identity := testSnapshotKeys(t, dir)
+
+	for _, size := range []int{0, 1, encChunkSize, 3*encChunkSize + 5} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		for _, compression := range []string{CompressionNone, CompressionZstd} {
+			for _, keys := range [][2]*SnapshotKey{{keyFile, keyFile}, {recipient, identity}} {
+				data := encodeSnapshot(t, plain, SnapshotOptions{Compression: compression, Key: keys[0]})
+				got, format, err := decodeSnapshotBytes(data, keys[1])
+				if err != nil {
+					t.Fatalf("size %d %q: %v", size, compression, err)
+				}
+				if !bytes.Equal(got, plain) || !format.encrypted || format.compression != compression {
+					t.Errorf("size %d %q: round trip failed, format %+v", size, compression, format)
+				}
+			}
+		}
+	}
+
+	plain := make([]byte, 2*encChunkSize+100)
+	rand.Read(plain)
+	data := encodeSnapshot(t, plain, SnapshotOptions{Key: recipient})
+	sealed := encChunkSize + 16
+	bad := map[string]struct {
+		data []byte
+		key  *SnapshotKey
+	}{
+		"no key":          {data, nil},
+		"wrong key":       {data, keyFile},
+		"truncated":       {data[:len(data)-(len(data)-len(encMagic)-33)%sealed], identity},
+		"tampered":        {append(append([]byte{}, data[:100]...), append([]byte{data[100] ^ 1}, data[101:]...)...), identity},
+		"tampered header": {append(append([]byte{}, data[:20]...), append([]byte{data[20] ^ 1}, data[21:]...)...), identity},
+	}
+	for name, c := range bad {
+		if _, _, err := decodeSnapshotBytes(c.data, c.key); err == nil {
+			t.Errorf("%s: decrypted", name)
+		}
+	}
+}
+
+func TestGenerateSnapshotIdentityUsesRoot(t *testing.T) {
+	fs := NewMemFS()
+	o := DefaultOptions()
+	o.FS, o.Root = fs, "/mnt/master-0"
+	if err := fs.MkdirAll("/mnt/master-0/etc/etcd", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateSnapshotIdentity(o, "/etc/etcd/identity"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"identity", "identity.pub"} {
+		if _, err := fs.Stat("/mnt/master-0/etc/etcd/" + name); err != nil {
+			t.Errorf("%s not written below the root (%v)", name, err)
+		}
+	}
+	if err := GenerateSnapshotIdentity(o, "/etc/etcd/identity"); err == nil {
+		t.Error("existing identity replaced")
+	}
+	if _, err := LoadSnapshotIdentity(o, "/etc/etcd/identity"); err != nil {
+		t.Error(err)
+	}
+	if _, err := LoadSnapshotRecipient(o, "/etc/etcd/identity.pub"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,164 @@
+package etcdutils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// DefaultPrefixDepth groups keys like /kubernetes.io/secrets/<ns>/<name>
+// by /kubernetes.io/secrets.
+const DefaultPrefixDepth = 2
+
+// snapshotOpenTimeout bounds the wait for the lock of a db file, which a
+// running member holds for as long as it runs.
+const snapshotOpenTimeout = time.Second
+
+// PrefixUsage is the space used by the keys below a prefix. Keys counts
+// the live keys, Revisions every stored revision including deletions, and
+// Bytes the size of all revisions.
+type PrefixUsage struct {
+	Prefix    string `json:"prefix"`
+	Keys      int    `json:"keys"`
+	Revisions int    `json:"revisions"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// SnapshotStatus describes a snapshot or backend db file. Hash, Revision,
+// TotalKeys and TotalSize match etcdctl snapshot status.
+type SnapshotStatus struct {
+	Hash      uint32        `json:"hash"`
+	Revision  int64         `json:"revision"`
+	TotalKeys int           `json:"totalKeys"`
+	TotalSize int64         `json:"totalSize"`
+	Prefixes  []PrefixUsage `json:"prefixes"`
+}
+
+func (s *SnapshotStatus) Print(w io.Writer) {
+	fmt.Fprintf(w, "hash:       %x\n", s.Hash)
+	fmt.Fprintf(w, "revision:   %d\n", s.Revision)
+	fmt.Fprintf(w, "total keys: %d\n", s.TotalKeys)
+	fmt.Fprintf(w, "total size: %d\n", s.TotalSize)
+	fmt.Fprintf(w, "\n%-40s %10s %10s %14s\n", "PREFIX", "KEYS", "REVISIONS", "BYTES")
+	for _, p := range s.Prefixes {
+		fmt.Fprintf(w, "%-40s %10d %10d %14d\n", p.Prefix, p.Keys, p.Revisions, p.Bytes)
+	}
+}
+
+// InspectSnapshot opens the bbolt file at dbPath, resolved below the root
+// of o, read-only and reports its status, with the keys grouped by their
+// first depth path segments. Compressed or encrypted snapshots are decoded
+// to a temp file next to dbPath first, using key for encrypted ones, so the
+// plain db stays on the same filesystem as the snapshot and not in a shared
+// temp dir. bbolt opens the db by path, so o must use a host FS.
+func InspectSnapshot(o *Options, dbPath string, depth int, key *SnapshotKey) (*SnapshotStatus, error) {
+	dbPath = o.resolve(dbPath)
+	rawPath, cleanup, err := decodeSnapshot(o.fs(), dbPath, filepath.Dir(dbPath), key)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	db, err := bolt.Open(rawPath, 0400, &bolt.Options{ReadOnly: true, Timeout: snapshotOpenTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("db %s is in use, probably by a running etcd member; stop it or inspect a snapshot instead", dbPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	s := &SnapshotStatus{}
+	usage := map[string]*PrefixUsage{}
+	live := map[string]bool{}
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+
+	err = db.View(func(tx *bolt.Tx) error {
+		var errs []string
+		for err := range tx.Check() {
+			errs = append(errs, err.Error())
+		}
+		if len(errs) != 0 {
+			return fmt.Errorf("snapshot integrity check failed: %s", strings.Join(errs, "; "))
+		}
+		s.TotalSize = tx.Size()
+
+		c := tx.Cursor()
+		for name, _ := c.First(); name != nil; name, _ = c.Next() {
+			b := tx.Bucket(name)
+			if b == nil {
+				return fmt.Errorf("cannot get hash of bucket %s", name)
+			}
+			h.Write(name)
+			isKeyBucket := string(name) == "key"
+			err := b.ForEach(func(k, v []byte) error {
+				h.Write(k)
+				h.Write(v)
+				s.TotalKeys++
+				if !isKeyBucket {
+					return nil
+				}
+				// Revisions are stored in order as main and sub revision,
+				// with a trailing 't' for deletions.
+				s.Revision = int64(binary.BigEndian.Uint64(k[0:8]))
+				var kv mvccpb.KeyValue
+				if err := kv.Unmarshal(v); err != nil {
+					return fmt.Errorf("could not decode revision %d (%v)", s.Revision, err)
+				}
+				prefix := keyPrefix(string(kv.Key), depth)
+				u, ok := usage[prefix]
+				if !ok {
+					u = &PrefixUsage{Prefix: prefix}
+					usage[prefix] = u
+				}
+				u.Revisions++
+				u.Bytes += int64(len(k) + len(v))
+				live[string(kv.Key)] = !(len(k) == 18 && k[17] == 't')
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.Hash = h.Sum32()
+
+	for key, ok := range live {
+		if ok {
+			usage[keyPrefix(key, depth)].Keys++
+		}
+	}
+	for _, u := range usage {
+		s.Prefixes = append(s.Prefixes, *u)
+	}
+	sort.Slice(s.Prefixes, func(i, j int) bool {
+		if s.Prefixes[i].Bytes != s.Prefixes[j].Bytes {
+			return s.Prefixes[i].Bytes > s.Prefixes[j].Bytes
+		}
+		return s.Prefixes[i].Prefix < s.Prefixes[j].Prefix
+	})
+	return s, nil
+}
+
+// keyPrefix returns the first depth path segments of key.
+func keyPrefix(key string, depth int) string {
+	segments := strings.SplitAfter(key, "/")
+	if strings.HasPrefix(key, "/") {
+		depth++
+	}
+	if len(segments) <= depth {
+		return key
+	}
+	return strings.TrimSuffix(strings.Join(segments[:depth], ""), "/")
+}
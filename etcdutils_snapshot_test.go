@@ -0,0 +1,484 @@
+package etcdutils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+)
+
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// startTestEtcd runs a single member etcd in dir with a few keys and
+// returns its client config.
+func startTestEtcd(t *testing.T, dir string) (clientv3.Config, func()) {
+	cfg := embed.NewConfig()
+	cfg.Dir = filepath.Join(dir, "etcd")
+	peer, client := freeURL(t), freeURL(t)
+	cfg.LPUrls, cfg.APUrls = []url.URL{peer}, []url.URL{peer}
+	cfg.LCUrls, cfg.ACUrls = []url.URL{client}, []url.URL{client}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		e.Close()
+		t.Fatal("etcd did not start")
+	}
+
+	clientCfg := clientv3.Config{Endpoints: []string{client.String()}, DialTimeout: 5 * time.Second}
+	cli, err := clientv3.New(clientCfg)
+	if err != nil {
+		e.Close()
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	for i := 0; i < 10; i++ {
+		if _, err = cli.Put(context.Background(), fmt.Sprintf("/registry/pods/%d", i), "pod"); err != nil {
+			e.Close()
+			t.Fatal(err)
+		}
+	}
+	return clientCfg, e.Close
+}
+
+func TestSaveAndRestoreSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg, stop := startTestEtcd(t, dir)
+	defer stop()
+
+	dbPath := filepath.Join(dir, "snapshot.db")
+	if err = SaveSnapshot(context.Background(), DefaultOptions(), cfg, dbPath, SnapshotOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := ReadSnapshotMetadata(DefaultOptions(), dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Endpoint != cfg.Endpoints[0] || meta.TotalKeys != 10 || meta.Revision != 11 || meta.MemberID == "" || meta.DBSize != meta.Size {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+	if err = VerifySnapshot(DefaultOptions(), dbPath, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	restoreCfg := embed.NewConfig()
+	restoreCfg.Dir = filepath.Join(dir, "restored")
+	meta.SHA256 = strings.Repeat("0", 64)
+	if err = writeSnapshotMetadata(OSFS{}, dbPath, meta); err != nil {
+		t.Fatal(err)
+	}
+	if err = RestoreSnapshot(context.Background(), DefaultOptions(), *restoreCfg, nil, dbPath, false, nil); err == nil {
+		t.Fatal("restored a snapshot that does not match its metadata")
+	}
+	if _, err = os.Stat(restoreCfg.Dir); !os.IsNotExist(err) {
+		t.Errorf("refused restore created %s", restoreCfg.Dir)
+	}
+	if err = RestoreSnapshot(context.Background(), DefaultOptions(), *restoreCfg, nil, dbPath, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(OSFS{}, filepath.Join(restoreCfg.Dir, "member", "snap", "db")) {
+		t.Error("snapshot not restored")
+	}
+
+	o := DefaultOptions()
+	o.FS = renameFailFS{from: restoreCfg.Dir + ".restore.tmp"}
+	if err = RestoreSnapshot(context.Background(), o, *restoreCfg, nil, dbPath, true, nil); err == nil {
+		t.Fatal("expected the swap into the data-dir to fail")
+	}
+	if !fileExists(OSFS{}, filepath.Join(restoreCfg.Dir, "member", "snap", "db")) {
+		t.Error("data-dir not put back after a failed swap")
+	}
+	for _, leftover := range []string{".old", ".restore.tmp"} {
+		if _, err = os.Stat(restoreCfg.Dir + leftover); !os.IsNotExist(err) {
+			t.Errorf("%s left behind after a failed swap (%v)", restoreCfg.Dir+leftover, err)
+		}
+	}
+}
+
+// renameFailFS fails to rename from.
+type renameFailFS struct {
+	OSFS
+	from string
+}
+
+func (f renameFailFS) Rename(oldpath, newpath string) error {
+	if oldpath == f.from {
+		return errors.New("device busy")
+	}
+	return f.OSFS.Rename(oldpath, newpath)
+}
+
+func TestCompressedSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg, stop := startTestEtcd(t, dir)
+	defer stop()
+
+	for _, compression := range []string{CompressionGzip, CompressionZstd} {
+		dbPath := filepath.Join(dir, "snapshot.db."+compression)
+		if err = SaveSnapshot(context.Background(), DefaultOptions(), cfg, dbPath, SnapshotOptions{Compression: compression}); err != nil {
+			t.Fatal(err)
+		}
+		if meta, err := ReadSnapshotMetadata(DefaultOptions(), dbPath); err != nil || meta.DBSize <= meta.Size {
+			t.Errorf("%s snapshot: metadata %+v, want a db larger than the file (%v)", compression, meta, err)
+		}
+		f := mustOpen(t, dbPath)
+		_, detected, _ := newSnapshotReader(f, nil)
+		f.Close()
+		if detected.compression != compression {
+			t.Errorf("%s snapshot detected as %q", compression, detected.compression)
+		}
+		if err = VerifySnapshot(DefaultOptions(), dbPath, nil); err != nil {
+			t.Errorf("%s: %v", compression, err)
+		}
+		status, err := InspectSnapshot(DefaultOptions(), dbPath, DefaultPrefixDepth, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Revision != 11 {
+			t.Errorf("%s: got revision %d, want 11", compression, status.Revision)
+		}
+
+		restoreCfg := embed.NewConfig()
+		restoreCfg.Dir = filepath.Join(dir, "restored-"+compression)
+		if err = RestoreSnapshot(context.Background(), DefaultOptions(), *restoreCfg, nil, dbPath, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		if !fileExists(OSFS{}, filepath.Join(restoreCfg.Dir, "member", "snap", "db")) {
+			t.Errorf("%s snapshot not restored", compression)
+		}
+		if leftover, _ := filepath.Glob(filepath.Join(dir, "snapshot-*.db")); len(leftover) != 0 {
+			t.Errorf("decompressed snapshot left behind: %v", leftover)
+		}
+	}
+
+	err = SaveSnapshot(context.Background(), DefaultOptions(), cfg, filepath.Join(dir, "x.db"), SnapshotOptions{Compression: "lz4"})
+	if err == nil {
+		t.Error("unknown compression accepted")
+	}
+}
+
+func TestEncryptedSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg, stop := startTestEtcd(t, dir)
+	defer stop()
+	_, recipient, identity := testSnapshotKeys(t, dir)
+
+	dbPath := filepath.Join(dir, "snapshot.db.enc")
+	opts := SnapshotOptions{Compression: CompressionZstd, Key: recipient}
+	if err = SaveSnapshot(context.Background(), DefaultOptions(), cfg, dbPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := ReadSnapshotMetadata(DefaultOptions(), dbPath); err != nil || !meta.Encrypted {
+		t.Errorf("metadata %+v, err %v", meta, err)
+	}
+	if err = VerifySnapshot(DefaultOptions(), dbPath, nil); err == nil {
+		t.Error("verified encrypted snapshot without key")
+	}
+	if err = VerifySnapshot(DefaultOptions(), dbPath, identity); err != nil {
+		t.Fatal(err)
+	}
+	status, err := InspectSnapshot(DefaultOptions(), dbPath, DefaultPrefixDepth, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Revision != 11 {
+		t.Errorf("got revision %d, want 11", status.Revision)
+	}
+
+	restoreCfg := embed.NewConfig()
+	restoreCfg.Dir = filepath.Join(dir, "restored")
+	if err = RestoreSnapshot(context.Background(), DefaultOptions(), *restoreCfg, nil, dbPath, false, recipient); err == nil {
+		t.Fatal("restored with the public key only")
+	}
+	if err = RestoreSnapshot(context.Background(), DefaultOptions(), *restoreCfg, nil, dbPath, false, identity); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(OSFS{}, filepath.Join(restoreCfg.Dir, "member", "snap", "db")) {
+		t.Error("snapshot not restored")
+	}
+}
+
+func mustOpen(t *testing.T, path string) *os.File {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestSaveSnapshotSkipsDeadEndpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg, stop := startTestEtcd(t, dir)
+	defer stop()
+
+	dead := freeURL(t)
+	live := cfg.Endpoints[0]
+	cfg.Endpoints = []string{dead.String(), live}
+	cfg.DialTimeout = time.Second
+	dbPath := filepath.Join(dir, "snapshot.db")
+	if err = SaveSnapshot(context.Background(), DefaultOptions(), cfg, dbPath, SnapshotOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := ReadSnapshotMetadata(DefaultOptions(), dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Endpoint != live {
+		t.Errorf("snapshot taken from %s, want %s", meta.Endpoint, live)
+	}
+}
+
+// cutProxy forwards connections to target and cuts each one once it has
+// sent limit bytes back to the client. The returned func closes the proxy
+// and the connections it holds.
+func cutProxy(t *testing.T, target string, limit int64) (string, *int32, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		cuts  int32
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			backend, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			mu.Lock()
+			conns = append(conns, conn, backend)
+			mu.Unlock()
+			go io.Copy(backend, conn)
+			go func() {
+				if n, _ := io.CopyN(conn, backend, limit); n == limit {
+					atomic.AddInt32(&cuts, 1)
+				}
+				conn.Close()
+				backend.Close()
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String(), &cuts, func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+}
+
+func TestSaveSnapshotRetriesBrokenStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg, stop := startTestEtcd(t, dir)
+	defer stop()
+
+	cli, err := clientv3.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 16; i++ {
+		if _, err = cli.Put(context.Background(), fmt.Sprintf("/registry/configmaps/%d", i), strings.Repeat("x", 16*1024)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cli.Close()
+
+	live := cfg.Endpoints[0]
+	u, err := url.Parse(live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client retries a stream that broke before its first message, so
+	// the proxy passes the status calls and a few 32KiB chunks of the db
+	// before it cuts the stream.
+	broken, cuts, closeProxy := cutProxy(t, u.Host, 96*1024)
+	defer closeProxy()
+	cfg.Endpoints = []string{broken, live}
+	cfg.DialTimeout = time.Second
+	dbPath := filepath.Join(dir, "snapshot.db")
+	if err = SaveSnapshot(context.Background(), DefaultOptions(), cfg, dbPath, SnapshotOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(cuts) == 0 {
+		t.Fatal("snapshot stream through the proxy was not cut")
+	}
+	meta, err := ReadSnapshotMetadata(DefaultOptions(), dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Endpoint != live {
+		t.Errorf("snapshot taken from %s, want %s", meta.Endpoint, live)
+	}
+	if _, err = os.Stat(dbPath + ".part"); !os.IsNotExist(err) {
+		t.Errorf("partial snapshot left behind (%v)", err)
+	}
+}
+
+func TestRankEndpoints(t *testing.T) {
+	got := rankEndpoints([]endpointStatus{
+		{endpoint: "leader", leader: true, raftIndex: 12},
+		{endpoint: "behind", raftIndex: 9},
+		{endpoint: "ahead", raftIndex: 11},
+	})
+	want := []string{"ahead", "behind", "leader"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCheckSnapshotHash(t *testing.T) {
+	f, err := ioutil.TempFile("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(make([]byte, 512+32))
+	f.Close()
+
+	if hasHash, _, err := checkSnapshotHash(OSFS{}, f.Name(), nil); !hasHash || err == nil {
+		t.Errorf("zeroed hash accepted: hash %v, err %v", hasHash, err)
+	}
+	os.Truncate(f.Name(), 512)
+	hasHash, digest, err := checkSnapshotHash(OSFS{}, f.Name(), nil)
+	if hasHash || err != nil {
+		t.Errorf("snapshot without hash: hash %v, err %v", hasHash, err)
+	}
+	if digest.size != 512 || digest.sha256 != "076a27c79e5ace2a3d47f9dd2e83e4ff6ea8872b3c2218f66c92b89b55f36560" {
+		t.Errorf("digest = %+v, want that of 512 zero bytes", digest)
+	}
+}
+
+func TestInspectSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg, stop := startTestEtcd(t, dir)
+	defer stop()
+
+	cli, err := clientv3.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	ctx := context.Background()
+	cli.Put(ctx, "/kubernetes.io/secrets/default/token", strings.Repeat("s", 1000))
+	cli.Put(ctx, "/kubernetes.io/secrets/default/token", strings.Repeat("s", 1000))
+	cli.Delete(ctx, "/registry/pods/0")
+
+	dbPath := filepath.Join(dir, "snapshot.db")
+	if err = SaveSnapshot(ctx, DefaultOptions(), cfg, dbPath, SnapshotOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	status, err := InspectSnapshot(DefaultOptions(), dbPath, DefaultPrefixDepth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Revision != 14 || status.TotalSize == 0 || status.Hash == 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	usage := map[string]PrefixUsage{}
+	for _, p := range status.Prefixes {
+		usage[p.Prefix] = p
+	}
+	if p := usage["/registry/pods"]; p.Keys != 9 || p.Revisions != 11 {
+		t.Errorf("/registry/pods usage = %+v, want 9 keys in 11 revisions", p)
+	}
+	if p := usage["/kubernetes.io/secrets"]; p.Keys != 1 || p.Revisions != 2 || p.Bytes < 2000 {
+		t.Errorf("/kubernetes.io/secrets usage = %+v", p)
+	}
+	if status.Prefixes[0].Prefix != "/kubernetes.io/secrets" {
+		t.Errorf("largest prefix = %s", status.Prefixes[0].Prefix)
+	}
+
+	if _, err = InspectSnapshot(DefaultOptions(), filepath.Join(dir, "etcd", "member", "snap", "db"), DefaultPrefixDepth, nil); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("inspecting the db of the running member returned %v, want it to be in use", err)
+	}
+}
+
+func TestVerifySnapshotUsesRoot(t *testing.T) {
+	fs := NewMemFS()
+	o := DefaultOptions()
+	o.FS, o.Root = fs, "/mnt/master-0"
+	if err := fs.MkdirAll("/mnt/master-0/backup", 0755); err != nil {
+		t.Fatal(err)
+	}
+	db := make([]byte, 512)
+	sum := sha256.Sum256(db)
+	snap := append(db, sum[:]...)
+	digest := sha256.Sum256(snap)
+	if err := fs.WriteFile("/mnt/master-0/backup/snapshot.db", snap, 0600); err != nil {
+		t.Fatal(err)
+	}
+	meta := &SnapshotMetadata{Size: int64(len(snap)), SHA256: hex.EncodeToString(digest[:])}
+	if err := writeSnapshotMetadata(fs, "/mnt/master-0/backup/snapshot.db", meta); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifySnapshot(o, "/backup/snapshot.db", nil); err != nil {
+		t.Fatal(err)
+	}
+	meta.Size++
+	if err := writeSnapshotMetadata(fs, "/mnt/master-0/backup/snapshot.db", meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySnapshot(o, "/backup/snapshot.db", nil); err == nil {
+		t.Error("snapshot not matching its metadata verified")
+	}
+}
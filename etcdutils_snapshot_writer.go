@@ -0,0 +1,213 @@
+package etcdutils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressions of saved snapshots.
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// SnapshotOptions control how SaveSnapshot writes a snapshot.
+type SnapshotOptions struct {
+	// Compression is CompressionNone, CompressionGzip or CompressionZstd.
+	Compression string
+	// Key encrypts the snapshot if set.
+	Key *SnapshotKey
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// chainWriteCloser closes the writers of a chain from the outermost in.
+type chainWriteCloser struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (c chainWriteCloser) Close() error {
+	for _, closer := range c.closers {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newSnapshotWriter returns a writer compressing and then encrypting to w.
+// Closing it flushes the compressor and seals the last chunk but does not
+// close w.
+func newSnapshotWriter(w io.Writer, opts SnapshotOptions) (io.WriteCloser, error) {
+	var closers []io.Closer
+	if opts.Key != nil {
+		enc, err := newSnapshotEncrypter(w, opts.Key)
+		if err != nil {
+			return nil, err
+		}
+		w, closers = enc, []io.Closer{enc}
+	}
+
+	var zw io.WriteCloser
+	switch opts.Compression {
+	case CompressionNone:
+		zw = nopWriteCloser{w}
+	case CompressionGzip:
+		zw = gzip.NewWriter(w)
+	case CompressionZstd:
+		var err error
+		if zw, err = zstd.NewWriter(w); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown snapshot compression %q", opts.Compression)
+	}
+	return chainWriteCloser{zw, append([]io.Closer{zw}, closers...)}, nil
+}
+
+// snapshotFormat is how a snapshot file is encoded.
+type snapshotFormat struct {
+	compression string
+	encrypted   bool
+}
+
+func (f snapshotFormat) raw() bool {
+	return f.compression == CompressionNone && !f.encrypted
+}
+
+// newSnapshotReader detects the encryption and compression of the snapshot
+// read from r and returns a reader of the plain snapshot. key is only
+// needed for encrypted snapshots.
+func newSnapshotReader(r io.Reader, key *SnapshotKey) (io.ReadCloser, snapshotFormat, error) {
+	var format snapshotFormat
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(encMagic)); string(magic) == encMagic {
+		format.encrypted = true
+		br.Discard(len(encMagic))
+		dr, err := newSnapshotDecrypter(br, key)
+		if err != nil {
+			return nil, format, err
+		}
+		br = bufio.NewReader(dr)
+	}
+
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		format.compression = CompressionGzip
+		zr, err := gzip.NewReader(br)
+		return zr, format, err
+	case bytes.HasPrefix(magic, zstdMagic):
+		format.compression = CompressionZstd
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, format, err
+		}
+		return zr.IOReadCloser(), format, nil
+	}
+	return ioutil.NopCloser(br), format, nil
+}
+
+// decodeSnapshot returns the path of the plain snapshot at dbPath, which is
+// dbPath itself unless it is compressed or encrypted. Those are decoded to
+// a private temp file in dir, which the returned func removes. dbPath is
+// read through fs, but dir is a host dir: bbolt and the etcd restore open
+// the plain snapshot by its path.
+func decodeSnapshot(fs FS, dbPath, dir string, key *SnapshotKey) (string, func(), error) {
+	f, err := fs.Open(dbPath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	r, format, err := newSnapshotReader(f, key)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not read snapshot %s (%v)", dbPath, err)
+	}
+	defer r.Close()
+	if format.raw() {
+		return dbPath, func() {}, nil
+	}
+
+	tmp, err := ioutil.TempFile(dir, "snapshot-*.db")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		cleanup()
+		return "", nil, fmt.Errorf("could not decode snapshot %s (%v)", dbPath, err)
+	}
+	if err = tmp.Close(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return tmp.Name(), cleanup, nil
+}
+
+// snapshotHashWriter hashes an uncompressed snapshot as it is streamed. It
+// holds back the last 32 bytes, which are the sha256 etcd appends to the
+// db.
+type snapshotHashWriter struct {
+	h    hash.Hash
+	tail []byte
+	n    int64
+}
+
+func newSnapshotHashWriter() *snapshotHashWriter {
+	return &snapshotHashWriter{h: sha256.New()}
+}
+
+func (w *snapshotHashWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	buf := append(w.tail, p...)
+	if keep := len(buf) - sha256.Size; keep > 0 {
+		w.h.Write(buf[:keep])
+		buf = append(buf[:0], buf[keep:]...)
+	}
+	w.tail = buf
+	return len(p), nil
+}
+
+// check verifies the appended sha256 and reports whether there is one at
+// all.
+func (w *snapshotHashWriter) check() (bool, error) {
+	// The db is a multiple of 512 bytes, the hash makes it 32 bytes more.
+	if w.n%512 != sha256.Size {
+		return false, nil
+	}
+	if got := w.h.Sum(nil); !bytes.Equal(got, w.tail) {
+		return true, fmt.Errorf("sha256 %x, want %x", got, w.tail)
+	}
+	return true, nil
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
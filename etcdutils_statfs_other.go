@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package etcdutils
+
+import "fmt"
+
+func diskFree(path string) (uint64, error) {
+	return 0, fmt.Errorf("free disk space is not supported on this platform")
+}
@@ -0,0 +1,282 @@
+package etcdutils
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// Names of the manifests rendered by PopulateManifests.
+const (
+	EtcdMemberTemplate        = "etcd-member.yaml"
+	EtcdGenerateCertsTemplate = "etcd-generate-certs.yaml"
+)
+
+// TemplateParams are the cluster parameters substituted into the manifest
+// templates.
+type TemplateParams struct {
+	// MemberName is the name of the etcd member, etcd-member-<hostname>.
+	MemberName string
+	// IP is the node address etcd listens on and advertises.
+	IP string
+	// DNSName is the member's name in the discovery domain, e.g.
+	// etcd-0.cluster.example.com, which the member certs are named after.
+	DNSName         string
+	DiscoveryDomain string
+
+	EtcdImage                 string
+	SetupEtcdEnvironmentImage string
+	KubeClientAgentImage      string
+
+	InitialCluster string
+	// InitialClusterState defaults to existing.
+	InitialClusterState string
+
+	// CertDir, DataDir and Kubeconfig are paths on the node. They default
+	// to the options and the kubeconfig in the shared asset dir.
+	CertDir    string
+	DataDir    string
+	Kubeconfig string
+}
+
+func (p TemplateParams) withDefaults(o *Options) TemplateParams {
+	if p.InitialClusterState == "" {
+		p.InitialClusterState = "existing"
+	}
+	if p.CertDir == "" {
+		p.CertDir = o.EtcdStaticResourceDir
+	}
+	if p.DataDir == "" {
+		p.DataDir = o.EtcdDataDir
+	}
+	if p.Kubeconfig == "" {
+		p.Kubeconfig, _ = filepath.Abs(filepath.Join(o.AssetDir, "shared", "kubeconfig"))
+	}
+	return p
+}
+
+var templateFuncs = template.FuncMap{
+	"required": func(name, value string) (string, error) {
+		if value == "" {
+			return "", fmt.Errorf("%s must be set", name)
+		}
+		return value, nil
+	},
+}
+
+// loadTemplate returns the template name from assets/templates/<name>.template,
+// or the built-in one if there is none.
+func loadTemplate(o *Options, name string) (*template.Template, error) {
+	text, ok := defaultTemplates[name]
+	path := o.AssetPath("templates", name+".template")
+	if data, err := readFile(o.fs(), path); err == nil {
+		log.Printf("Using template %s\n", path)
+		text, ok = string(data), true
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("no template %s in %s", name, o.AssetPath("templates"))
+	}
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+// PopulateTemplate renders the template name with params into the stopped
+// manifest dir, from where StartEtcd and StartCertRecover move it in place.
+// The member manifest is written under o.EtcdManifestName.
+func PopulateTemplate(o *Options, name string, params TemplateParams) error {
+	t, err := loadTemplate(o, name)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, params.withDefaults(o)); err != nil {
+		return fmt.Errorf("could not render %s (%v)", name, err)
+	}
+
+	out := o.ManifestStoppedPath(name)
+	if name == EtcdMemberTemplate {
+		out = o.StoppedEtcdManifest()
+	}
+	if o.planned(ActionWrite, out, "render template "+name) {
+		return nil
+	}
+	if err = o.fs().MkdirAll(filepath.Dir(out), os.ModePerm); err != nil {
+		return err
+	}
+	log.Printf("Writing %s..\n", out)
+	return writeFileAtomic(o.fs(), out, buf.Bytes(), 0644)
+}
+
+// PopulateManifests renders the etcd member and cert recovery manifests.
+func PopulateManifests(o *Options, params TemplateParams) error {
+	for _, name := range []string{EtcdMemberTemplate, EtcdGenerateCertsTemplate} {
+		if err := PopulateTemplate(o, name, params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var defaultTemplates = map[string]string{
+	EtcdMemberTemplate: `apiVersion: v1
+kind: Pod
+metadata:
+  name: etcd-member
+  namespace: openshift-etcd
+  labels:
+    k8s-app: etcd
+spec:
+  containers:
+  - name: etcd-member
+    image: {{required "EtcdImage" .EtcdImage}}
+    command:
+    - /bin/sh
+    - -c
+    - |
+      #!/bin/sh
+      set -euo pipefail
+
+      exec etcd \
+        --name={{required "MemberName" .MemberName}} \
+        --data-dir=/var/lib/etcd \
+        --initial-cluster={{required "InitialCluster" .InitialCluster}} \
+        --initial-cluster-state={{.InitialClusterState}} \
+        --initial-advertise-peer-urls=https://{{required "IP" .IP}}:2380 \
+        --listen-peer-urls=https://0.0.0.0:2380 \
+        --listen-client-urls=https://0.0.0.0:2379 \
+        --advertise-client-urls=https://{{.IP}}:2379 \
+        --cert-file=/etc/ssl/etcd/system:etcd-server:{{required "DNSName" .DNSName}}.crt \
+        --key-file=/etc/ssl/etcd/system:etcd-server:{{.DNSName}}.key \
+        --trusted-ca-file=/etc/ssl/etcd/ca.crt \
+        --client-cert-auth=true \
+        --peer-cert-file=/etc/ssl/etcd/system:etcd-peer:{{.DNSName}}.crt \
+        --peer-key-file=/etc/ssl/etcd/system:etcd-peer:{{.DNSName}}.key \
+        --peer-trusted-ca-file=/etc/ssl/etcd/ca.crt \
+        --peer-client-cert-auth=true
+    ports:
+    - name: peer
+      containerPort: 2380
+      protocol: TCP
+    - name: server
+      containerPort: 2379
+      protocol: TCP
+    resources:
+      requests:
+        cpu: 300m
+        memory: 600Mi
+    securityContext:
+      privileged: true
+    volumeMounts:
+    - name: certs
+      mountPath: /etc/ssl/etcd/
+    - name: data-dir
+      mountPath: /var/lib/etcd/
+  hostNetwork: true
+  priorityClassName: system-node-critical
+  tolerations:
+  - operator: Exists
+  volumes:
+  - name: certs
+    hostPath:
+      path: {{.CertDir}}
+  - name: data-dir
+    hostPath:
+      path: {{.DataDir}}
+`,
+	EtcdGenerateCertsTemplate: `apiVersion: v1
+kind: Pod
+metadata:
+  name: etcd-generate-certs
+  namespace: openshift-etcd
+  labels:
+    k8s-app: etcd
+spec:
+  initContainers:
+  - name: discovery
+    image: {{required "SetupEtcdEnvironmentImage" .SetupEtcdEnvironmentImage}}
+    command: ["/usr/bin/setup-etcd-environment"]
+    args:
+    - --discovery-srv={{required "DiscoveryDomain" .DiscoveryDomain}}
+    - --output-file=/run/etcd/environment
+    - --v=4
+    securityContext:
+      privileged: true
+    volumeMounts:
+    - name: discovery
+      mountPath: /run/etcd/
+  - name: certs
+    image: {{required "KubeClientAgentImage" .KubeClientAgentImage}}
+    command:
+    - /bin/sh
+    - -c
+    - |
+      #!/bin/sh
+      set -euo pipefail
+
+      source /run/etcd/environment
+
+      [ -e /etc/ssl/etcd/system:etcd-server:${ETCD_DNS_NAME}.crt -a \
+        -e /etc/ssl/etcd/system:etcd-server:${ETCD_DNS_NAME}.key ] || \
+        kube-client-agent \
+          request \
+            --kubeconfig=/etc/kubernetes/kubeconfig \
+            --orgname=system:etcd-servers \
+            --assetsdir=/etc/ssl/etcd \
+            --dnsnames=localhost,etcd.kube-system.svc,etcd.kube-system.svc.cluster.local,etcd.openshift-etcd.svc,etcd.openshift-etcd.svc.cluster.local,${ETCD_DNS_NAME} \
+            --commonname=system:etcd-server:${ETCD_DNS_NAME} \
+            --ipaddrs=${ETCD_IPV4_ADDRESS},127.0.0.1
+
+      [ -e /etc/ssl/etcd/system:etcd-peer:${ETCD_DNS_NAME}.crt -a \
+        -e /etc/ssl/etcd/system:etcd-peer:${ETCD_DNS_NAME}.key ] || \
+        kube-client-agent \
+          request \
+            --kubeconfig=/etc/kubernetes/kubeconfig \
+            --orgname=system:etcd-peers \
+            --assetsdir=/etc/ssl/etcd \
+            --dnsnames=${ETCD_DNS_NAME},{{.DiscoveryDomain}} \
+            --commonname=system:etcd-peer:${ETCD_DNS_NAME} \
+            --ipaddrs=${ETCD_IPV4_ADDRESS}
+
+      [ -e /etc/ssl/etcd/system:etcd-metric:${ETCD_DNS_NAME}.crt -a \
+        -e /etc/ssl/etcd/system:etcd-metric:${ETCD_DNS_NAME}.key ] || \
+        kube-client-agent \
+          request \
+            --kubeconfig=/etc/kubernetes/kubeconfig \
+            --orgname=system:etcd-metrics \
+            --assetsdir=/etc/ssl/etcd \
+            --dnsnames=localhost,etcd.kube-system.svc,etcd.kube-system.svc.cluster.local,etcd.openshift-etcd.svc,etcd.openshift-etcd.svc.cluster.local,${ETCD_DNS_NAME} \
+            --commonname=system:etcd-metric:${ETCD_DNS_NAME} \
+            --ipaddrs=${ETCD_IPV4_ADDRESS}
+    securityContext:
+      privileged: true
+    volumeMounts:
+    - name: discovery
+      mountPath: /run/etcd/
+    - name: certs
+      mountPath: /etc/ssl/etcd/
+    - name: kubeconfig
+      mountPath: /etc/kubernetes/kubeconfig
+  containers:
+  - name: wait
+    image: {{.KubeClientAgentImage}}
+    command: ["/bin/sh", "-c", "sleep infinity"]
+  hostNetwork: true
+  priorityClassName: system-node-critical
+  tolerations:
+  - operator: Exists
+  volumes:
+  - name: discovery
+    hostPath:
+      path: /run/etcd
+  - name: certs
+    hostPath:
+      path: {{.CertDir}}
+  - name: kubeconfig
+    hostPath:
+      path: {{.Kubeconfig}}
+`,
+}
@@ -0,0 +1,74 @@
+package etcdutils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPopulateManifests(t *testing.T) {
+	o := &Options{Paths: DefaultOptions().Paths, FS: NewMemFS()}
+	o.EtcdManifestName = "etcd-pod.yaml"
+	params := TemplateParams{
+		MemberName:                "etcd-member-master-0",
+		IP:                        "10.0.0.1",
+		DNSName:                   "etcd-0.cluster.example.com",
+		DiscoveryDomain:           "cluster.example.com",
+		EtcdImage:                 "quay.io/openshift/etcd:v3.3.17",
+		SetupEtcdEnvironmentImage: "quay.io/openshift/setup-etcd-environment",
+		KubeClientAgentImage:      "quay.io/openshift/kube-client-agent",
+		InitialCluster:            "etcd-member-master-0=https://10.0.0.1:2380",
+	}
+	if err := PopulateManifests(o, params); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := LoadManifest(o, o.StoppedEtcdManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(o.fs(), o.ManifestStoppedPath(EtcdMemberTemplate)) {
+		t.Errorf("member manifest written as %s, not %s", EtcdMemberTemplate, o.EtcdManifestName)
+	}
+	data, _ := readFile(o.fs(), m.path)
+	for _, want := range []string{
+		"--name=etcd-member-master-0",
+		"--initial-cluster-state=existing",
+		"--initial-advertise-peer-urls=https://10.0.0.1:2380",
+		"system:etcd-server:etcd-0.cluster.example.com.crt",
+		"path: /etc/kubernetes/static-pod-resources/etcd-member",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("etcd-member.yaml does not contain %q", want)
+		}
+	}
+	m, err = LoadManifest(o, o.ManifestStoppedPath(EtcdGenerateCertsTemplate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.container("certs"); err != nil {
+		t.Error(err)
+	}
+
+	params.EtcdImage = ""
+	if err = PopulateTemplate(o, EtcdMemberTemplate, params); err == nil || !strings.Contains(err.Error(), "EtcdImage") {
+		t.Errorf("expected missing EtcdImage error, got %v", err)
+	}
+}
+
+func TestPopulateTemplateOverride(t *testing.T) {
+	o := &Options{Paths: DefaultOptions().Paths, FS: NewMemFS()}
+	fs := o.FS.(*MemFS)
+	if err := fs.WriteFile(o.AssetPath("templates", "etcd-member.yaml.template"), []byte("image: {{.EtcdImage}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := PopulateTemplate(o, EtcdMemberTemplate, TemplateParams{EtcdImage: "etcd:test"}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := readFile(fs, o.StoppedEtcdManifest())
+	if string(data) != "image: etcd:test\n" {
+		t.Errorf("rendered %q from the asset template", data)
+	}
+	if err := PopulateTemplate(o, "kube-apiserver.yaml", TemplateParams{}); err == nil {
+		t.Error("expected an error for an unknown template")
+	}
+}
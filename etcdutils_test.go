@@ -1,11 +1,34 @@
 package etcdutils
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
 )
 
 func TestInit(t *testing.T) {
-	Init("")
+	dir, err := ioutil.TempDir("", "init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := DefaultOptions()
+	o.Root = dir
+	if err = Init(o); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "assets", "backup")); err != nil {
+		t.Error(err)
+	}
 }
 
 func TestGenConfig(t *testing.T) {
@@ -18,3 +41,173 @@ func TestGenConfig(t *testing.T) {
 	}
 	GenConfig(params)
 }
+
+func TestDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dryrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plan := &Plan{}
+	o := DefaultOptions()
+	o.EtcdDataDir = dir
+	o.Plan = plan
+	if err = RemoveDataDir(o); err != nil {
+		t.Fatal(err)
+	}
+	if err = StopKubelet(context.Background(), o); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(dir); err != nil {
+		t.Errorf("dry run removed %s: %v", dir, err)
+	}
+	want := []Action{
+		{Kind: ActionDelete, Target: dir},
+		{Kind: ActionStopService, Target: "kubelet.service"},
+	}
+	if !reflect.DeepEqual(plan.Actions, want) {
+		t.Errorf("plan = %v, want %v", plan.Actions, want)
+	}
+}
+
+func TestDryRunWithoutRuntime(t *testing.T) {
+	o := newTestMaster(t)
+	o.Runtime = &FakeRuntime{ListErr: errors.New("crictl: executable file not found")}
+	o.Plan = &Plan{}
+	if err := StopEtcd(context.Background(), o); err != nil {
+		t.Fatal(err)
+	}
+	want := Action{Kind: ActionStopContainer, Target: "openshift-etcd/etcd-member*", Detail: "could not list containers: crictl: executable file not found"}
+	if n := len(o.Plan.Actions); n == 0 || o.Plan.Actions[n-1] != want {
+		t.Errorf("plan = %v, want it to end with %v", o.Plan.Actions, want)
+	}
+
+	o.Plan = nil
+	if err := StopEtcd(context.Background(), o); err == nil {
+		t.Error("expected the listing error outside of a dry run")
+	}
+}
+
+func TestStopAllContainers(t *testing.T) {
+	rt := &FakeRuntime{
+		Containers: []Container{
+			{ID: "1", Name: "etcd-member", PodName: "etcd-member-master-0", Namespace: "openshift-etcd"},
+			{ID: "2", Name: "etcd-metrics", PodName: "etcd-member-master-0", Namespace: "openshift-etcd"},
+			{ID: "3", Name: "kube-apiserver-2", PodName: "kube-apiserver-master-0", Namespace: "openshift-kube-apiserver"},
+		},
+		Stuck: map[string]bool{"2": true},
+	}
+	o := DefaultOptions()
+	o.Runtime = rt
+	running, err := StopAllContainers(context.Background(), o, EtcdContainers)
+	if err == nil {
+		t.Fatal("expected an error for the stuck container")
+	}
+	if len(running) != 1 || running[0].ID != "2" {
+		t.Errorf("running = %v, want container 2", running)
+	}
+	if want := []string{"1", "2"}; !reflect.DeepEqual(rt.Stopped, want) {
+		t.Errorf("stopped = %v, want %v", rt.Stopped, want)
+	}
+}
+
+func TestValidateEnvironment(t *testing.T) {
+	o := newTestMaster(t)
+	o.Services = &FakeServiceManager{}
+	status := map[string]string{}
+	for _, c := range ValidateEnvironment(o) {
+		status[c.Name] = c.Status
+	}
+	want := map[string]string{
+		"manifest dir":         CheckPass,
+		"static-pod-resources": CheckPass,
+		"etcd data-dir":        CheckPass,
+		"asset dir disk space": CheckWarn,
+		"etcd client certs":    CheckPass,
+		"etcd member certs":    CheckPass,
+	}
+	for name, s := range want {
+		if status[name] != s {
+			t.Errorf("check %q = %q, want %q", name, status[name], s)
+		}
+	}
+	if _, ok := status["systemctl"]; ok {
+		t.Error("systemctl checked although a fake service manager is used")
+	}
+}
+
+func TestValidateEtcdName(t *testing.T) {
+	defer func(h func() (string, error)) { hostname = h }(hostname)
+	hostname = func() (string, error) { return "master-0", nil }
+
+	o := newTestMaster(t)
+	fs := o.FS.(*MemFS)
+	manifest := "command:\n- /bin/sh\n- -c\n- exec etcd --name=etcd-member-master-0 --data-dir=/var/lib/etcd\n"
+	if err := fs.WriteFile(o.EtcdManifest(), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err := ValidateEtcdName(context.Background(), o, clientv3.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Canonical != "etcd-member-master-0" {
+		t.Errorf("canonical name = %q, want etcd-member-master-0", report.Canonical)
+	}
+
+	hostname = func() (string, error) { return "master-1", nil }
+	report, err = ValidateEtcdName(context.Background(), o, clientv3.Config{})
+	if err == nil || len(report.Mismatches) != 1 {
+		t.Errorf("expected hostname mismatch, got %v", err)
+	}
+}
+
+func TestParseEtcdConf(t *testing.T) {
+	conf := `# generated by the installer
+ETCD_NAME=etcd-member-master-0
+ETCD_DATA_DIR="/var/lib/etcd"
+ETCD_INITIAL_CLUSTER=etcd-member-master-0=https://10.0.0.1:2380,etcd-member-master-1=https://10.0.0.2:2380
+ETCD_INITIAL_ADVERTISE_PEER_URLS=https://10.0.0.1:2380
+ETCD_LISTEN_PEER_URLS=https://0.0.0.0:2380
+ETCD_PEER_CERT_FILE=/etc/ssl/etcd/peer.crt
+ETCD_PEER_CLIENT_CERT_AUTH=true
+ETCD_QUOTA_BACKEND_BYTES='7516192768'
+`
+	c, err := ParseEtcdConf(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "etcd-member-master-0" || c.DataDir != "/var/lib/etcd" || !c.PeerClientCertAuth {
+		t.Errorf("unexpected conf %+v", c)
+	}
+	if c.Env["ETCD_QUOTA_BACKEND_BYTES"] != "7516192768" {
+		t.Errorf("unmapped variable = %q", c.Env["ETCD_QUOTA_BACKEND_BYTES"])
+	}
+
+	o := DefaultOptions()
+	o.Root = "/mnt/master-0"
+	o.EtcdDataDir = "/srv/etcd"
+	cfg := embed.NewConfig()
+	if err = c.ApplyTo(o, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Name != c.Name || cfg.InitialCluster != c.InitialCluster {
+		t.Errorf("embed config not filled: %s %s", cfg.Name, cfg.InitialCluster)
+	}
+	if cfg.Dir != "/mnt/master-0/var/lib/etcd" || o.DataDir() != cfg.Dir {
+		t.Errorf("data-dir = %s, options data-dir = %s, want both below the root", cfg.Dir, o.DataDir())
+	}
+	if len(cfg.APUrls) != 1 || cfg.APUrls[0].Host != "10.0.0.1:2380" {
+		t.Errorf("advertise peer URLs = %v", cfg.APUrls)
+	}
+	if cfg.InitialClusterToken != "etcd-cluster" {
+		t.Errorf("unset token overwritten with %q", cfg.InitialClusterToken)
+	}
+	if cfg.PeerTLSInfo.CertFile != "/etc/ssl/etcd/peer.crt" || !cfg.PeerTLSInfo.ClientCertAuth {
+		t.Errorf("peer TLS = %+v", cfg.PeerTLSInfo)
+	}
+
+	if _, err = ParseEtcdConf(strings.NewReader("ETCD_NAME\n")); err == nil {
+		t.Error("expected an error for a line without =")
+	}
+}
@@ -0,0 +1,64 @@
+package etcdutils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// ClientTLSFiles are the PEM files of an etcd client identity.
+type ClientTLSFiles struct {
+	CACert string
+	Cert   string
+	Key    string
+}
+
+// EtcdClientTLSFiles returns the etcd client certs saved by
+// BackupEtcdClientCerts. Before they are backed up, the ones found in the
+// kube-apiserver static pod resources are returned instead.
+func EtcdClientTLSFiles(o *Options) ClientTLSFiles {
+	if !etcdClientCertsBackedUp(o) {
+		if dir, ok := findEtcdClientCerts(o); ok {
+			return ClientTLSFiles{
+				CACert: dir + "/configmaps/etcd-serving-ca/ca-bundle.crt",
+				Cert:   dir + "/secrets/etcd-client/tls.crt",
+				Key:    dir + "/secrets/etcd-client/tls.key",
+			}
+		}
+	}
+	return ClientTLSFiles{
+		CACert: o.BackupPath("etcd-ca-bundle.crt"),
+		Cert:   o.BackupPath("etcd-client.crt"),
+		Key:    o.BackupPath("etcd-client.key"),
+	}
+}
+
+// ClientTLSConfig returns the TLS config of a client authenticating with
+// files, which are read through o's filesystem.
+func ClientTLSConfig(o *Options, files ClientTLSFiles) (*tls.Config, error) {
+	caPEM, err := readFile(o.fs(), files.CACert)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := readFile(o.fs(), files.Cert)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := readFile(o.fs(), files.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("could not load client cert %s (%v)", files.Cert, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no CA certs found in %s", files.CACert)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}, nil
+}
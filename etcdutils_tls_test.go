@@ -0,0 +1,92 @@
+package etcdutils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *rsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert issues a cert for cn signed by ca, or a self-signed CA cert
+// if ca is nil.
+func newTestCert(t *testing.T, ca *testCert, cn string) *testCert {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		tmpl.ExtKeyUsage = nil
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	o := newTestMaster(t)
+	fs := o.FS.(*MemFS)
+	ca := newTestCert(t, nil, "etcd-signer")
+	client := newTestCert(t, ca, "etcd")
+
+	// Before the backup the certs are used where kube-apiserver has them.
+	files := EtcdClientTLSFiles(o)
+	if files.Cert != o.KubernetesPath("static-pod-resources", "kube-apiserver-pod-3", "secrets", "etcd-client", "tls.crt") {
+		t.Errorf("client cert = %s, want the kube-apiserver one", files.Cert)
+	}
+
+	fs.WriteFile(o.BackupPath("etcd-ca-bundle.crt"), ca.certPEM, 0600)
+	fs.WriteFile(o.BackupPath("etcd-client.crt"), client.certPEM, 0600)
+	fs.WriteFile(o.BackupPath("etcd-client.key"), client.keyPEM, 0600)
+	files = EtcdClientTLSFiles(o)
+	if files.CACert != o.BackupPath("etcd-ca-bundle.crt") {
+		t.Errorf("CA = %s, want the backed up one", files.CACert)
+	}
+	cfg, err := ClientTLSConfig(o, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Certificates) != 1 || cfg.RootCAs == nil {
+		t.Errorf("incomplete TLS config %+v", cfg)
+	}
+
+	files.Key = o.KubernetesPath("static-pod-resources", "kube-apiserver-pod-3", "secrets", "etcd-client", "tls.key")
+	if _, err = ClientTLSConfig(o, files); err == nil {
+		t.Error("expected an error for a mismatched key")
+	}
+}
@@ -0,0 +1,136 @@
+package etcdutils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+const (
+	etcdStopTimeout    = 2 * time.Minute
+	etcdHealthyTimeout = 5 * time.Minute
+	etcdPollInterval   = 2 * time.Second
+	etcdStatusTimeout  = 5 * time.Second
+)
+
+var etcdPorts = []int{2379, 2380}
+
+// WaitForEtcdStopped waits until the etcd client and peer ports are free
+// and no etcd process is left on the node, or ctx is done.
+func WaitForEtcdStopped(ctx context.Context, o *Options) error {
+	if o.DryRun() {
+		return nil
+	}
+	for {
+		reason := etcdRunning()
+		if reason == "" {
+			log.Println("etcd is stopped")
+			return nil
+		}
+		log.Printf("Waiting for etcd to stop, %s..\n", reason)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("etcd did not stop, %s: %v", reason, ctx.Err())
+		case <-time.After(etcdPollInterval):
+		}
+	}
+}
+
+// etcdRunning returns why etcd is considered running, or "" if it is not.
+func etcdRunning() string {
+	for _, port := range etcdPorts {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			return fmt.Sprintf("port %d is in use", port)
+		}
+		l.Close()
+	}
+	comms, _ := filepath.Glob("/proc/[0-9]*/comm")
+	for _, comm := range comms {
+		name, err := ioutil.ReadFile(comm)
+		if err == nil && strings.TrimSpace(string(name)) == "etcd" {
+			return fmt.Sprintf("etcd process %s is running", filepath.Base(filepath.Dir(comm)))
+		}
+	}
+	return ""
+}
+
+// WaitForEtcdHealthy waits until the member at cfg.Endpoints[0] reports its
+// status and serves linearizable reads, or ctx is done.
+func WaitForEtcdHealthy(ctx context.Context, o *Options, cfg clientv3.Config) error {
+	if len(cfg.Endpoints) != 1 {
+		return fmt.Errorf("health must be checked on one selected node, not multiple %#v", cfg.Endpoints)
+	}
+	if o.DryRun() {
+		return nil
+	}
+	cli, err := clientv3.New(cfg)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	for {
+		if err = checkEtcdHealth(ctx, cli, cfg.Endpoints[0]); err == nil {
+			log.Printf("etcd member %s is healthy\n", cfg.Endpoints[0])
+			return nil
+		}
+		log.Printf("Waiting for etcd member %s to become healthy: %v\n", cfg.Endpoints[0], err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("etcd member %s is not healthy: %v", cfg.Endpoints[0], err)
+		case <-time.After(etcdPollInterval):
+		}
+	}
+}
+
+func checkEtcdHealth(ctx context.Context, cli *clientv3.Client, endpoint string) error {
+	ctx, cancel := context.WithTimeout(ctx, etcdPollInterval)
+	defer cancel()
+	if _, err := cli.Status(ctx, endpoint); err != nil {
+		return err
+	}
+	// Like etcdctl endpoint health, a denied read still proves the member
+	// has a leader and serves linearizable requests.
+	if _, err := cli.Get(ctx, "health"); err != nil && err != rpctypes.ErrPermissionDenied {
+		return err
+	}
+	return nil
+}
+
+// WaitForEtcdStoppedStep waits for etcd to be gone after it was stopped.
+func WaitForEtcdStoppedStep(o *Options) Step {
+	return Step{
+		Name: "wait for etcd to stop",
+		Do: func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, etcdStopTimeout)
+			defer cancel()
+			return WaitForEtcdStopped(ctx, o)
+		},
+	}
+}
+
+// WaitForEtcdHealthyStep waits for the member at cfg's endpoint to serve
+// requests. Without an endpoint the check is skipped.
+func WaitForEtcdHealthyStep(o *Options, cfg clientv3.Config) Step {
+	return Step{
+		Name: "wait for etcd to become healthy",
+		Do: func(ctx context.Context) error {
+			if len(cfg.Endpoints) == 0 {
+				log.Println("No etcd endpoint given, health check skipped..")
+				return nil
+			}
+			ctx, cancel := context.WithTimeout(ctx, etcdHealthyTimeout)
+			defer cancel()
+			return WaitForEtcdHealthy(ctx, o, cfg)
+		},
+	}
+}
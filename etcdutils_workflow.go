@@ -0,0 +1,179 @@
+package etcdutils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Step is a single unit of work in a Workflow. Undo, when set, compensates
+// for a successful Do and is run if a later step of the workflow fails.
+// Inputs are recorded in the journal and must match when a run is resumed.
+type Step struct {
+	Name   string
+	Inputs map[string]string
+	Do     func(ctx context.Context) error
+	Undo   func(ctx context.Context) error
+}
+
+// Workflow runs its steps in order. When a step fails, the steps that
+// already completed are unwound in reverse order through their Undo.
+// With a Journal attached, steps recorded as done by an earlier run are
+// skipped, so an interrupted workflow resumes where it stopped.
+type Workflow struct {
+	Name    string
+	Steps   []Step
+	Journal *Journal
+}
+
+func NewWorkflow(name string, steps ...Step) *Workflow {
+	return &Workflow{Name: name, Steps: steps}
+}
+
+func (w *Workflow) Run(ctx context.Context) error {
+	var done []Step
+	for i, step := range w.Steps {
+		if w.Journal != nil {
+			if err := w.Journal.CheckInputs(step.Name, step.Inputs); err != nil {
+				return err
+			}
+			if w.Journal.Completed(step.Name) {
+				log.Printf("%s: step %d/%d: %s already completed, skipping\n", w.Name, i+1, len(w.Steps), step.Name)
+				done = append(done, step)
+				continue
+			}
+		}
+		log.Printf("%s: step %d/%d: %s..\n", w.Name, i+1, len(w.Steps), step.Name)
+		err := ctx.Err()
+		if err == nil {
+			err = w.record(step, OutcomeStarted, nil)
+		}
+		if err == nil {
+			err = step.Do(ctx)
+			if err != nil {
+				w.record(step, OutcomeFailed, err)
+			} else {
+				err = w.record(step, OutcomeDone, nil)
+			}
+		}
+		if err != nil {
+			log.Printf("%s: step %d/%d: %s failed: %v\n", w.Name, i+1, len(w.Steps), step.Name, err)
+			if rbErr := w.rollback(done); rbErr != nil {
+				return fmt.Errorf("%s: %v (rollback failed: %v)", step.Name, err, rbErr)
+			}
+			return fmt.Errorf("%s: %v", step.Name, err)
+		}
+		done = append(done, step)
+	}
+	if w.Journal != nil {
+		if err := w.Journal.Finish(); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	log.Printf("%s: complete\n", w.Name)
+	return nil
+}
+
+func (w *Workflow) record(step Step, outcome string, stepErr error) error {
+	if w.Journal == nil {
+		return nil
+	}
+	if err := w.Journal.Record(step.Name, step.Inputs, outcome, stepErr); err != nil {
+		return fmt.Errorf("could not update journal %s (%v)", w.Journal.Path(), err)
+	}
+	return nil
+}
+
+// rollback undoes the completed steps in reverse order. It keeps going past
+// failing undo actions so as much as possible is put back. Steps without
+// Undo are journaled as rolled back too: a rerun starts over from the state
+// the rollback restored, so their work has to be done again, e.g. waiting
+// for etcd to stop after a rolled back step started it.
+func (w *Workflow) rollback(done []Step) error {
+	// The run context may be what failed the workflow, undo must still run.
+	ctx := context.Background()
+	var failed []string
+	for i := len(done) - 1; i >= 0; i-- {
+		step := done[i]
+		if step.Undo == nil {
+			if err := w.record(step, OutcomeRolledBack, nil); err != nil {
+				failed = append(failed, err.Error())
+			}
+			continue
+		}
+		log.Printf("%s: rolling back %s..\n", w.Name, step.Name)
+		if err := step.Undo(ctx); err != nil {
+			log.Printf("%s: rolling back %s failed: %v\n", w.Name, step.Name, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", step.Name, err))
+			continue
+		}
+		if err := w.record(step, OutcomeRolledBack, nil); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// StopEtcdStep stops etcd by moving its manifest out of the manifest dir and
+// starts it again on rollback.
+func StopEtcdStep(o *Options) Step {
+	return Step{
+		Name:   "stop etcd",
+		Inputs: map[string]string{"manifest": o.EtcdManifest(), "stopped-dir": o.ManifestStoppedPath()},
+		Do:     func(ctx context.Context) error { return StopEtcd(ctx, o) },
+		Undo:   func(ctx context.Context) error { return StartEtcd(o) },
+	}
+}
+
+// StartEtcdStep moves the etcd manifest back into the manifest dir. On
+// rollback it stops etcd again and waits for it to be gone, so the steps
+// unwound before it never touch the data-dir of a running member.
+func StartEtcdStep(o *Options) Step {
+	return Step{
+		Name: "start etcd",
+		Do:   func(ctx context.Context) error { return StartEtcd(o) },
+		Undo: func(ctx context.Context) error {
+			if err := StopEtcd(ctx, o); err != nil {
+				return err
+			}
+			ctx, cancel := context.WithTimeout(ctx, etcdStopTimeout)
+			defer cancel()
+			return WaitForEtcdStopped(ctx, o)
+		},
+	}
+}
+
+// StopKubeletStep stops the kubelet service and starts it again on rollback.
+func StopKubeletStep(o *Options) Step {
+	return Step{
+		Name: "stop kubelet",
+		Do:   func(ctx context.Context) error { return StopKubelet(ctx, o) },
+		Undo: func(ctx context.Context) error { return StartKubelet(ctx, o) },
+	}
+}
+
+// StopStaticPodsStep moves all static pod manifests away and moves them back
+// on rollback.
+func StopStaticPodsStep(o *Options) Step {
+	return Step{
+		Name:   "stop static pods",
+		Inputs: map[string]string{"manifest-dir": o.ManifestPath(), "stopped-dir": o.ManifestStoppedPath()},
+		Do:     func(ctx context.Context) error { return StopStaticPods(ctx, o) },
+		Undo:   func(ctx context.Context) error { return StartStaticPods(o) },
+	}
+}
+
+// StartCertRecoverStep starts the etcd client cert recovery agent and stops
+// it again on rollback.
+func StartCertRecoverStep(o *Options) Step {
+	return Step{
+		Name: "start cert recovery agent",
+		Do:   func(ctx context.Context) error { return StartCertRecover(o) },
+		Undo: func(ctx context.Context) error { return StopCertRecover(o) },
+	}
+}
@@ -0,0 +1,167 @@
+package etcdutils
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func recordingStep(name string, calls *[]string, fail bool) Step {
+	return Step{
+		Name: name,
+		Do: func(ctx context.Context) error {
+			*calls = append(*calls, "do "+name)
+			if fail {
+				return errors.New("boom")
+			}
+			return nil
+		},
+		Undo: func(ctx context.Context) error {
+			*calls = append(*calls, "undo "+name)
+			return nil
+		},
+	}
+}
+
+func TestWorkflowRun(t *testing.T) {
+	var calls []string
+	wf := NewWorkflow("test",
+		recordingStep("a", &calls, false),
+		recordingStep("b", &calls, false),
+	)
+	if err := wf.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"do a", "do b"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestWorkflowRollback(t *testing.T) {
+	var calls []string
+	noUndo := recordingStep("b", &calls, false)
+	noUndo.Undo = nil
+	wf := NewWorkflow("test",
+		recordingStep("a", &calls, false),
+		noUndo,
+		recordingStep("c", &calls, false),
+		recordingStep("d", &calls, true),
+		recordingStep("e", &calls, false),
+	)
+	if err := wf.Run(context.Background()); err == nil {
+		t.Fatal("expected workflow to fail")
+	}
+	want := []string{"do a", "do b", "do c", "do d", "undo c", "undo a"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestWorkflowJournalResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	run := func(failB bool) ([]string, error) {
+		var calls []string
+		a := recordingStep("a", &calls, false)
+		a.Undo = nil
+		b := recordingStep("b", &calls, failB)
+		wf := NewWorkflow("test", a, b)
+		if wf.Journal, err = OpenJournal(&Options{Paths: Paths{AssetDir: dir}}, wf.Name); err != nil {
+			t.Fatal(err)
+		}
+		return calls, wf.Run(context.Background())
+	}
+
+	// A run killed after a, which never got to roll back.
+	j, err := OpenJournal(&Options{Paths: Paths{AssetDir: dir}}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = j.Record("a", nil, OutcomeDone, nil); err != nil {
+		t.Fatal(err)
+	}
+	calls, err := run(false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"do b"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("resumed calls = %v, want %v", calls, want)
+	}
+	if fileExists(OSFS{}, filepath.Join(dir, "journal-test.json")) {
+		t.Error("journal of a completed workflow was not archived")
+	}
+	calls, _ = run(false)
+	if want := []string{"do a", "do b"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls after completion = %v, want %v", calls, want)
+	}
+}
+
+func TestWorkflowJournalRerunAfterRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	run := func(failC bool) ([]string, error) {
+		var calls []string
+		b := recordingStep("b", &calls, false)
+		b.Undo = nil
+		wf := NewWorkflow("test",
+			recordingStep("a", &calls, false),
+			b,
+			recordingStep("c", &calls, failC),
+		)
+		if wf.Journal, err = OpenJournal(&Options{Paths: Paths{AssetDir: dir}}, wf.Name); err != nil {
+			t.Fatal(err)
+		}
+		return calls, wf.Run(context.Background())
+	}
+
+	if _, err := run(true); err == nil {
+		t.Fatal("expected first run to fail")
+	}
+	// a was undone, so b, which has nothing to undo, must not be skipped
+	// either.
+	calls, err := run(false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"do a", "do b", "do c"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls after rollback = %v, want %v", calls, want)
+	}
+}
+
+func TestJournalCheckInputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := OpenJournal(&Options{Paths: Paths{AssetDir: dir}}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = j.Record("restore", map[string]string{"snapshot": "a.db"}, OutcomeDone, nil); err != nil {
+		t.Fatal(err)
+	}
+	if j, err = OpenJournal(&Options{Paths: Paths{AssetDir: dir}}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if !j.Completed("restore") {
+		t.Error("restore not completed after reload")
+	}
+	if err = j.CheckInputs("restore", map[string]string{"snapshot": "b.db"}); err == nil {
+		t.Error("expected mismatching inputs to be rejected")
+	}
+}